@@ -0,0 +1,536 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const UNSUPPORTED_ARCHIVE_MSG = "Unsupported archive format"
+const UNSUPPORTED_ENTRY_MSG = "Unsupported entry in archive"
+const INVALID_ENTRY_MSG = "Invalid entry in archive"
+const EXTRACT_LIMIT_MSG = "Archive exceeds the limit of"
+
+// The compression ratio is only checked after this many bytes are
+// extracted, so small archives of repetitive files are accepted.
+const minRatioCheckSize = 1 << 20
+
+// max size of the target of a symlink stored in a zip file
+const maxZipLinkSize = 4096
+
+// extractLimits are the limits for the contents of an archive.
+type extractLimits struct {
+	// total size of the extracted files
+	maxSize int64
+	// number of entries in the archive
+	maxEntries int64
+	// extracted size divided by the archive size
+	maxRatio int64
+}
+
+func newExtractLimits(c *DomainConfig) extractLimits {
+	return extractLimits{
+		maxSize:    valueOf(c.MaxExtractSize),
+		maxEntries: valueOf(c.MaxExtractEntries),
+		maxRatio:   valueOf(c.MaxCompressionRatio),
+	}
+}
+
+// extractCounter counts what is extracted from an archive with
+// `size` bytes. The bytes are counted while they are read, so it
+// does not matter what the headers of the archive say.
+type extractCounter struct {
+	limits  extractLimits
+	size    int64
+	written int64
+	entries int64
+}
+
+func (c *extractCounter) entry() error {
+	c.entries++
+	if c.limits.maxEntries > 0 && c.entries > c.limits.maxEntries {
+		return fmt.Errorf("%s %d entries", EXTRACT_LIMIT_MSG, c.limits.maxEntries)
+	}
+	return nil
+}
+
+func (c *extractCounter) add(n int64) error {
+	c.written += n
+	if c.limits.maxSize > 0 && c.written > c.limits.maxSize {
+		return fmt.Errorf("%s %d bytes", EXTRACT_LIMIT_MSG, c.limits.maxSize)
+	}
+	if c.limits.maxRatio > 0 && c.written > minRatioCheckSize &&
+		c.written > c.size*c.limits.maxRatio {
+		return fmt.Errorf("%s compression ratio %d",
+			EXTRACT_LIMIT_MSG, c.limits.maxRatio)
+	}
+	return nil
+}
+
+// reader returns a reader that fails when the limits are exceeded.
+func (c *extractCounter) reader(r io.Reader) io.Reader {
+	return &extractReader{r: r, counter: c}
+}
+
+type extractReader struct {
+	r       io.Reader
+	counter *extractCounter
+}
+
+func (r *extractReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if lerr := r.counter.add(int64(n)); lerr != nil {
+			return n, lerr
+		}
+	}
+	return n, err
+}
+
+// extractPreserve informs what is kept from the headers of the
+// archive entries. By default the extracted files have the same
+// mode and times of uploaded files.
+type extractPreserve struct {
+	mode  bool
+	umask fs.FileMode
+	mtime bool
+	// hard links are recreated instead of copied
+	links bool
+}
+
+func newExtractPreserve(c *DomainConfig) extractPreserve {
+	return extractPreserve{
+		mode:  c.ExtractPreserveMode,
+		umask: fs.FileMode(valueOf(c.ExtractUmask)) & fs.ModePerm,
+		mtime: c.ExtractPreserveMtime,
+		links: c.ExtractPreserveLinks,
+	}
+}
+
+// apply changes the mode and times of `fpath` to the ones of the
+// entry. Only the permission bits of the mode are used.
+func (p extractPreserve) apply(fpath string, e *archiveEntry) error {
+	if p.mode {
+		mode := fs.FileMode(e.mode) & fs.ModePerm &^ p.umask
+		err := os.Chmod(fpath, mode)
+		if err != nil {
+			return err
+		}
+	}
+	if p.mtime && !e.modTime.IsZero() {
+		err := os.Chtimes(fpath, e.modTime, e.modTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveEntry is an entry of an archive. The types of the entries
+// are the tar types, whatever the format of the archive.
+type archiveEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	size     int64
+	mode     int64
+	modTime  time.Time
+	// the contents of regular files
+	r io.Reader
+}
+
+// archiveReader iterates over the entries of an archive.
+type archiveReader interface {
+	// next returns the next entry of the archive or io.EOF
+	// when there are no more entries.
+	next() (*archiveEntry, error)
+	close() error
+}
+
+// openArchive returns a reader for an archive. The format of the
+// archive is detected from its first bytes.
+func openArchive(f io.ReaderAt, size int64) (archiveReader, error) {
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	sr := io.NewSectionReader(f, 0, size)
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")),
+		bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			return nil, err
+		}
+		return &zipArchive{files: zr.File}, nil
+
+	case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+		gr, err := gzip.NewReader(sr)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchive{tr: tar.NewReader(gr), closer: gr}, nil
+
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return &tarArchive{tr: tar.NewReader(bzip2.NewReader(sr))}, nil
+
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return &tarArchive{tr: tar.NewReader(sr)}, nil
+	}
+	return nil, errors.New(UNSUPPORTED_ARCHIVE_MSG)
+}
+
+// tarArchive reads tar files, compressed or not.
+type tarArchive struct {
+	tr     *tar.Reader
+	closer io.Closer
+}
+
+func (a *tarArchive) next() (*archiveEntry, error) {
+	hdr, err := a.tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	typeflag := hdr.Typeflag
+	if typeflag == tar.TypeRegA {
+		typeflag = tar.TypeReg
+	}
+	e := &archiveEntry{
+		name:     hdr.Name,
+		typeflag: typeflag,
+		linkname: hdr.Linkname,
+		size:     hdr.Size,
+		mode:     hdr.Mode,
+		modTime:  hdr.ModTime,
+		r:        a.tr,
+	}
+	return e, nil
+}
+
+func (a *tarArchive) close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// zipArchive reads zip files.
+type zipArchive struct {
+	files []*zip.File
+	// the contents of the current entry
+	current io.ReadCloser
+}
+
+func (a *zipArchive) next() (*archiveEntry, error) {
+	a.close()
+	if len(a.files) == 0 {
+		return nil, io.EOF
+	}
+	f := a.files[0]
+	a.files = a.files[1:]
+
+	mode := f.Mode()
+	e := &archiveEntry{
+		name:    f.Name,
+		size:    int64(f.UncompressedSize64),
+		mode:    int64(mode.Perm()),
+		modTime: f.Modified,
+	}
+	switch {
+	case mode.IsDir() || strings.HasSuffix(f.Name, "/"):
+		e.typeflag = tar.TypeDir
+		return e, nil
+
+	case mode&fs.ModeNamedPipe != 0:
+		e.typeflag = tar.TypeFifo
+		return e, nil
+
+	case mode&fs.ModeCharDevice != 0:
+		e.typeflag = tar.TypeChar
+		return e, nil
+
+	case mode&fs.ModeDevice != 0:
+		e.typeflag = tar.TypeBlock
+		return e, nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	a.current = rc
+	if mode&fs.ModeSymlink != 0 {
+		// the target of the link is the content of the entry
+		target, err := io.ReadAll(io.LimitReader(rc, maxZipLinkSize))
+		if err != nil {
+			return nil, err
+		}
+		e.typeflag = tar.TypeSymlink
+		e.linkname = string(target)
+		return e, nil
+	}
+	e.typeflag = tar.TypeReg
+	e.r = rc
+	return e, nil
+}
+
+func (a *zipArchive) close() error {
+	if a.current == nil {
+		return nil
+	}
+	err := a.current.Close()
+	a.current = nil
+	return err
+}
+
+// archiveWriter writes the entries of an archive.
+type archiveWriter interface {
+	// add adds an entry to the archive. `r` is the content of regular
+	// files and `linkname` the target of symlinks.
+	add(name string, info fs.FileInfo, linkname string, r io.Reader) error
+	close() error
+}
+
+// newArchiveWriter returns a writer for the archive `format`, that
+// is `tar.gz` or `zip`.
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, error) {
+	switch format {
+	case "tar.gz":
+		gw := gzip.NewWriter(w)
+		return &tarGzWriter{gw: gw, tw: tar.NewWriter(gw)}, nil
+
+	case "zip":
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, errors.New(UNSUPPORTED_ARCHIVE_MSG)
+}
+
+type tarGzWriter struct {
+	gw *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzWriter) add(name string, info fs.FileInfo, linkname string, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(info, linkname)
+	if err != nil {
+		// notest
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	err = a.tw.WriteHeader(hdr)
+	if err != nil || r == nil {
+		return err
+	}
+	// the file may have changed since it was listed
+	_, err = io.CopyN(a.tw, r, hdr.Size)
+	return err
+}
+
+func (a *tarGzWriter) close() error {
+	err := a.tw.Close()
+	if err != nil {
+		// notest
+		return err
+	}
+	return a.gw.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipWriter) add(name string, info fs.FileInfo, linkname string, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		// notest
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	} else {
+		hdr.Method = zip.Deflate
+	}
+	fw, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		// notest
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		// the target of the link is the content of the entry
+		_, err = io.WriteString(fw, linkname)
+		return err
+	}
+	if r == nil {
+		return nil
+	}
+	_, err = io.CopyN(fw, r, info.Size())
+	return err
+}
+
+func (a *zipWriter) close() error {
+	return a.zw.Close()
+}
+
+// writeArchive writes the contents of `dir` to an archive. Internal
+// and expired files are not written, neither are the symlinks that
+// point outside of `root`. Both paths must have their links resolved.
+func writeArchive(aw archiveWriter, dir string, root string) error {
+	return filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fpath == dir {
+			return nil
+		}
+		if isInternalPath(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// notest
+			return err
+		}
+		rel, _ := filepath.Rel(dir, fpath)
+		name := filepath.ToSlash(rel)
+		switch {
+		case d.IsDir():
+			return aw.add(name, info, "", nil)
+
+		case info.Mode()&fs.ModeSymlink != 0:
+			linkname, ok := archiveLinkname(fpath, root)
+			if !ok {
+				Debugf("skipping link outside of the root dir %s", fpath)
+				return nil
+			}
+			return aw.add(name, info, linkname, nil)
+
+		case info.Mode().IsRegular():
+			if isExpired(root, fpath) {
+				return nil
+			}
+			f, err := os.Open(fpath)
+			if err != nil {
+				// notest
+				return err
+			}
+			defer f.Close()
+			return aw.add(name, info, "", f)
+		}
+		// devices, pipes and sockets
+		return nil
+	})
+}
+
+// archiveLinkname returns the target of the link `fpath` relative to
+// the dir of the link, so the archive can be extracted anywhere. Broken
+// links and links that point outside of `root` are refused.
+func archiveLinkname(fpath string, root string) (string, bool) {
+	real, err := filepath.EvalSymlinks(fpath)
+	if err != nil || !isWithinDir(root, real) {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Dir(fpath), real)
+	if err != nil {
+		// notest
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+var archiveContentTypes = map[string]string{
+	"tar.gz": "application/gzip",
+	"zip":    "application/zip",
+}
+
+// serveDirArchive streams the directory addressed by the request as an
+// archive in `format`. The archive is written while the directory is
+// read so errors after the first bytes can only end the response.
+func serveDirArchive(w http.ResponseWriter, req *http.Request, c *DomainConfig, format string) {
+	ctype, ok := archiveContentTypes[format]
+	if !ok {
+		http.Error(w, UNSUPPORTED_ARCHIVE_MSG, http.StatusBadRequest)
+		return
+	}
+	root, err := filepath.EvalSymlinks(c.RootDir)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(root, req.URL.Path))
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if !isWithinDir(root, dir) {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		// notest
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "Only directories can be archived", http.StatusBadRequest)
+		return
+	}
+	name := path.Base(strings.TrimSuffix(req.URL.Path, "/"))
+	if name == "." || name == "/" {
+		name = "root"
+	}
+	aw, _ := newArchiveWriter(format, w)
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(
+		"attachment", map[string]string{"filename": name + "." + format}))
+	err = writeArchive(aw, dir, root)
+	if err == nil {
+		err = aw.close()
+	}
+	if err != nil {
+		Errorf("error writing archive for %s: %s\n", dir, err.Error())
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEntry is an entry for the archives created by createTestTarGz
+type testEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+func createTestTarGz(entries []testEntry) []byte {
+	hdrs := make([]*tar.Header, 0, len(entries))
+	contents := make([]string, 0, len(entries))
+	for _, e := range entries {
+		hdrs = append(hdrs, &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+		})
+		contents = append(contents, e.content)
+	}
+	return createTestTarGzHeaders(hdrs, contents)
+}
+
+func createTestTarGzHeaders(hdrs []*tar.Header, contents []string) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for i, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(contents[i]))
+		}
+		tw.WriteHeader(hdr)
+		if hdr.Size > 0 {
+			tw.Write([]byte(contents[i]))
+		}
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestExtractFiles_Hardening(t *testing.T) {
+	dir := "/tmp/tupitest-hardening"
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		name    string
+		entries []testEntry
+		errMsg  string
+	}{
+		{"dot dot", []testEntry{{"../evil.txt", tar.TypeReg, "", "x"}},
+			INVALID_ENTRY_MSG},
+		{"dot dot inside", []testEntry{{"a/../../evil.txt", tar.TypeReg, "", "x"}},
+			INVALID_ENTRY_MSG},
+		{"dot dot dir", []testEntry{{"../evil", tar.TypeDir, "", ""}},
+			INVALID_ENTRY_MSG},
+		{"absolute", []testEntry{{"/tmp/evil.txt", tar.TypeReg, "", "x"}},
+			INVALID_ENTRY_MSG},
+		{"internal", []testEntry{{".tupi/meta/a,meta", tar.TypeReg, "", "x"}},
+			INVALID_ENTRY_MSG},
+		{"through link", []testEntry{{"out/evil.txt", tar.TypeReg, "", "x"}},
+			INVALID_ENTRY_MSG},
+		{"hard link outside", []testEntry{
+			{"passwd", tar.TypeLink, "../../../etc/passwd", ""}},
+			INVALID_ENTRY_MSG},
+		{"hard link missing", []testEntry{
+			{"a.txt", tar.TypeLink, "missing.txt", ""}},
+			INVALID_ENTRY_MSG},
+		{"symlink to internal", []testEntry{
+			{"tus", tar.TypeSymlink, ".tupi/tus", ""}},
+			INVALID_ENTRY_MSG},
+		{"symlink to internal parent", []testEntry{
+			{"a/meta", tar.TypeSymlink, "../.tupi", ""}},
+			INVALID_ENTRY_MSG},
+		{"symlink to internal through link", []testEntry{
+			{"tus", tar.TypeSymlink, "internal/tus", ""}},
+			INVALID_ENTRY_MSG},
+		{"fifo", []testEntry{{"fifo", tar.TypeFifo, "", ""}},
+			UNSUPPORTED_ENTRY_MSG},
+		{"char device", []testEntry{{"null", tar.TypeChar, "", ""}},
+			UNSUPPORTED_ENTRY_MSG},
+		{"block device", []testEntry{{"sda", tar.TypeBlock, "", ""}},
+			UNSUPPORTED_ENTRY_MSG},
+		{"hard link", []testEntry{
+			{"a/one.txt", tar.TypeReg, "", "one"},
+			{"b/copy.txt", tar.TypeLink, "a/one.txt", ""}},
+			""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.RemoveAll(dir)
+			os.MkdirAll(root, 0755)
+			os.MkdirAll(outside, 0755)
+			os.Symlink(outside, filepath.Join(root, "out"))
+			os.MkdirAll(filepath.Join(root, ".tupi", "tus"), 0755)
+			os.Symlink(filepath.Join(root, ".tupi"), filepath.Join(root, "internal"))
+			b := createTestTarGz(test.entries)
+
+			_, err := extractFiles(
+				bytes.NewReader(b), int64(len(b)), root, uploadOptions{})
+
+			if test.errMsg == "" {
+				if err != nil {
+					t.Fatalf("error extracting %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), test.errMsg) {
+				t.Fatalf("bad error %v", err)
+			}
+			entries, _ := os.ReadDir(outside)
+			if len(entries) != 0 || fileExists(filepath.Join(dir, "evil.txt")) {
+				t.Fatalf("file extracted outside the root dir")
+			}
+		})
+	}
+
+	// the hard link is a copy of the linked file
+	c, _ := os.ReadFile(filepath.Join(root, "b", "copy.txt"))
+	if string(c) != "one" {
+		t.Fatalf("bad hard link content %q", c)
+	}
+	info, _ := os.Lstat(filepath.Join(root, "b", "copy.txt"))
+	if !info.Mode().IsRegular() {
+		t.Fatalf("hard link is not a regular file")
+	}
+}
+
+func TestExtractFiles_DotEntries(t *testing.T) {
+	root := "/tmp/tupitest-dot"
+	os.MkdirAll(root, 0755)
+	defer os.RemoveAll(root)
+
+	// created with tar czf dot.tar.gz -C dir .
+	b, _ := os.ReadFile("./testdata/dot.tar.gz")
+	files, err := extractFiles(bytes.NewReader(b), int64(len(b)), root, uploadOptions{})
+	if err != nil {
+		t.Fatalf("error extracting %s", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("bad files %+v", files)
+	}
+	for fname, content := range map[string]string{"one.txt": "one", "sub/two.txt": "two"} {
+		c, _ := os.ReadFile(filepath.Join(root, fname))
+		if string(c) != content {
+			t.Errorf("bad content for %s %q", fname, c)
+		}
+	}
+
+	// only a directory can be the root dir
+	b = createTestTarGz([]testEntry{{".", tar.TypeReg, "", "x"}})
+	_, err = extractFiles(bytes.NewReader(b), int64(len(b)), root, uploadOptions{})
+	if err == nil || !strings.HasPrefix(err.Error(), INVALID_ENTRY_MSG) {
+		t.Fatalf("bad error %v", err)
+	}
+}
+
+func TestExtractFiles_Cleanup(t *testing.T) {
+	root := "/tmp/tupitest-cleanup"
+	os.MkdirAll(filepath.Join(root, "a"), 0755)
+	defer os.RemoveAll(root)
+	os.WriteFile(filepath.Join(root, "a", "keep.txt"), []byte("keep"), 0644)
+
+	b := createTestTarGz([]testEntry{
+		{"a/new.txt", tar.TypeReg, "", "new"},
+		{"b/", tar.TypeDir, "", ""},
+		{"b/c/d.txt", tar.TypeReg, "", "d"},
+		{"b/link", tar.TypeSymlink, "c/d.txt", ""},
+		{"../evil.txt", tar.TypeReg, "", "x"},
+	})
+	_, err := extractFiles(bytes.NewReader(b), int64(len(b)), root, uploadOptions{})
+	if err == nil {
+		t.Fatalf("bad archive extracted")
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 || entries[0].Name() != "a" {
+		t.Fatalf("extracted files not removed %v", entries)
+	}
+	entries, _ = os.ReadDir(filepath.Join(root, "a"))
+	if len(entries) != 1 || entries[0].Name() != "keep.txt" {
+		t.Fatalf("bad files after clean up %v", entries)
+	}
+}
+
+func TestExtractFiles_Limits(t *testing.T) {
+	root := "/tmp/tupitest-limits"
+	defer os.RemoveAll(root)
+
+	zeros := strings.Repeat("0", 2<<20)
+	var tests = []struct {
+		name    string
+		entries []testEntry
+		limits  extractLimits
+		has_err bool
+	}{
+		{"entries", []testEntry{
+			{"a.txt", tar.TypeReg, "", "a"},
+			{"b.txt", tar.TypeReg, "", "b"},
+			{"c", tar.TypeDir, "", ""}},
+			extractLimits{maxEntries: 2}, true},
+		{"entries ok", []testEntry{
+			{"a.txt", tar.TypeReg, "", "a"},
+			{"b.txt", tar.TypeReg, "", "b"}},
+			extractLimits{maxEntries: 2}, false},
+		{"size", []testEntry{
+			{"a.txt", tar.TypeReg, "", "12345"},
+			{"b.txt", tar.TypeReg, "", "12345"}},
+			extractLimits{maxSize: 9}, true},
+		{"size with hard link", []testEntry{
+			{"a.txt", tar.TypeReg, "", "12345"},
+			{"b.txt", tar.TypeLink, "a.txt", ""}},
+			extractLimits{maxSize: 9}, true},
+		{"size ok", []testEntry{
+			{"a.txt", tar.TypeReg, "", "12345"},
+			{"b.txt", tar.TypeReg, "", "12345"}},
+			extractLimits{maxSize: 10}, false},
+		{"ratio", []testEntry{{"zeros.txt", tar.TypeReg, "", zeros}},
+			extractLimits{maxRatio: 100}, true},
+		{"no ratio", []testEntry{{"zeros.txt", tar.TypeReg, "", zeros}},
+			extractLimits{}, false},
+		// small files are not checked
+		{"small ratio", []testEntry{{"zeros.txt", tar.TypeReg, "", zeros[:1000]}},
+			extractLimits{maxRatio: 2}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.RemoveAll(root)
+			b := createTestTarGz(test.entries)
+			opts := uploadOptions{limits: test.limits}
+
+			_, err := extractFiles(bytes.NewReader(b), int64(len(b)), root, opts)
+
+			if (err != nil) != test.has_err {
+				t.Fatalf("bad error %v", err)
+			}
+			if err != nil && !strings.HasPrefix(err.Error(), EXTRACT_LIMIT_MSG) {
+				t.Fatalf("bad error %s", err)
+			}
+		})
+	}
+}
+
+func TestExtractFiles_Preserve(t *testing.T) {
+	root := "/tmp/tupitest-preserve"
+	defer os.RemoveAll(root)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	hdrs := []*tar.Header{
+		{Name: "d/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime},
+		{Name: "d/run.sh", Typeflag: tar.TypeReg, Mode: 04777, ModTime: mtime},
+		{Name: "d/secret.txt", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime},
+		{Name: "link.txt", Typeflag: tar.TypeLink, Linkname: "d/secret.txt",
+			Mode: 0600, ModTime: mtime},
+	}
+	contents := []string{"", "echo", "secret", ""}
+	b := createTestTarGzHeaders(hdrs, contents)
+
+	var tests = []struct {
+		name     string
+		preserve extractPreserve
+		modes    map[string]os.FileMode
+		mtime    bool
+		linked   bool
+	}{
+		{"defaults", extractPreserve{},
+			map[string]os.FileMode{"d": 0755, "d/run.sh": 0644, "d/secret.txt": 0644},
+			false, false},
+		{"mode", extractPreserve{mode: true, umask: 0022},
+			map[string]os.FileMode{"d": 0750, "d/run.sh": 0755, "d/secret.txt": 0600},
+			false, false},
+		{"mtime and links", extractPreserve{mtime: true, links: true},
+			map[string]os.FileMode{"d": 0755, "d/run.sh": 0644, "d/secret.txt": 0644},
+			true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.RemoveAll(root)
+			opts := uploadOptions{preserve: test.preserve}
+
+			files, err := extractFiles(bytes.NewReader(b), int64(len(b)), root, opts)
+
+			if err != nil {
+				t.Fatalf("error extracting %s", err)
+			}
+			if len(files) != 4 || files[3].sha256 != files[2].sha256 {
+				t.Fatalf("bad files %+v", files)
+			}
+			for name, mode := range test.modes {
+				info, _ := os.Stat(filepath.Join(root, name))
+				if info.Mode().Perm() != mode {
+					t.Fatalf("bad mode for %s %o", name, info.Mode().Perm())
+				}
+				if info.ModTime().Equal(mtime) != test.mtime {
+					t.Fatalf("bad mtime for %s %s", name, info.ModTime())
+				}
+			}
+			secret, _ := os.Stat(filepath.Join(root, "d/secret.txt"))
+			link, _ := os.Stat(filepath.Join(root, "link.txt"))
+			if os.SameFile(secret, link) != test.linked {
+				t.Fatalf("bad hard link")
+			}
+		})
+	}
+}
+
+func TestServeDirArchive(t *testing.T) {
+	dir := "/tmp/tupitest-dirarchive"
+	root := filepath.Join(dir, "root")
+	dest := filepath.Join(dir, "dest")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(root, 0755)
+	b, _ := os.ReadFile("./testdata/test.tar.gz")
+	_, err := extractFiles(bytes.NewReader(b), int64(len(b)), filepath.Join(root, "site"), uploadOptions{})
+	if err != nil {
+		t.Fatalf("error extracting %s", err)
+	}
+	os.WriteFile(filepath.Join(dir, "outside.txt"), []byte("out"), 0644)
+	os.Symlink(filepath.Join(dir, "outside.txt"), filepath.Join(root, "site", "out.txt"))
+	os.WriteFile(filepath.Join(root, "site", "expired.txt"), []byte("x"), 0644)
+	e := &expiry{root: root, at: time.Now().Add(time.Millisecond)}
+	e.set(filepath.Join(root, "site", "expired.txt"))
+	os.MkdirAll(filepath.Join(root, "site", internalDirName), 0755)
+	os.WriteFile(filepath.Join(root, "site", internalDirName, "x"), []byte("x"), 0644)
+	time.Sleep(time.Millisecond * 2)
+
+	dconf := DomainConfig{
+		Port:           8000,
+		RootDir:        root,
+		HtpasswdFile:   "./testdata/htpasswd",
+		AuthMethods:    []string{"GET"},
+		DefaultToIndex: new(bool),
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	var tests = []struct {
+		path   string
+		auth   bool
+		status int
+		ctype  string
+	}{
+		{"/site/?archive=tar.gz", false, 401, ""},
+		{"/site/?archive=tar.gz", true, 200, "application/gzip"},
+		{"/site?archive=zip", true, 200, "application/zip"},
+		{"/?archive=zip", true, 200, "application/zip"},
+		{"/site/?archive=rar", true, 400, ""},
+		{"/site/bla/one.txt?archive=zip", true, 400, ""},
+		{"/missing/?archive=zip", true, 404, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		if test.auth {
+			req.SetBasicAuth("test", "123")
+		}
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("got %d, expected %d for %s", w.Code, test.status, test.path)
+		}
+		if test.status != 200 {
+			continue
+		}
+		if w.Header().Get("Content-Type") != test.ctype {
+			t.Fatalf("bad content type %s", w.Header().Get("Content-Type"))
+		}
+		os.RemoveAll(dest)
+		body := w.Body.Bytes()
+		_, err := extractFiles(bytes.NewReader(body), int64(len(body)), dest, uploadOptions{})
+		if err != nil {
+			t.Fatalf("error extracting archive %s", err)
+		}
+		site := dest
+		if test.path == "/?archive=zip" {
+			site = filepath.Join(dest, "site")
+		}
+		c, err := os.ReadFile(filepath.Join(site, "bla", "ble", "four.txt"))
+		if err != nil || string(c) != "333\n" {
+			t.Fatalf("bad link content %q %v", c, err)
+		}
+		link, _ := os.Readlink(filepath.Join(site, "bla", "ble", "four.txt"))
+		if !strings.HasPrefix(link, dest) {
+			t.Fatalf("link outside of the extracted dir %s", link)
+		}
+		for _, name := range []string{"out.txt", "expired.txt", internalDirName} {
+			if _, err := os.Lstat(filepath.Join(site, name)); err == nil {
+				t.Fatalf("%s in the archive", name)
+			}
+		}
+	}
+}
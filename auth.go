@@ -18,6 +18,7 @@
 package tupi
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"net/http"
@@ -87,10 +88,13 @@ func userSecret(username string, fpath string) (string, error) {
 	return pwd, err
 }
 
-func basicAuth(r *http.Request, fpath string) (bool, int) {
+// basicAuth authenticates a request using a htpasswd file. Returns if
+// the request is authenticated, the status for the response and the
+// name of the authenticated user.
+func basicAuth(r *http.Request, fpath string) (bool, int, string) {
 
 	if fpath == "" {
-		return false, http.StatusUnauthorized
+		return false, http.StatusUnauthorized, ""
 	}
 
 	var ret bool = false
@@ -102,15 +106,19 @@ func basicAuth(r *http.Request, fpath string) (bool, int) {
 	}
 	a := &auth.BasicAuth{Realm: realm, Secrets: sprovider}
 
-	if username := a.CheckAuth(r); username != "" {
+	username := a.CheckAuth(r)
+	if username != "" {
 		ret = true
 		status = http.StatusOK
 	}
 
-	return ret, status
+	return ret, status, username
 }
 
-func authenticate(r *http.Request, conf *DomainConfig) (bool, int) {
+// authenticate authenticates a request using basic auth or an auth plugin.
+// Returns if the request is authenticated, the status for the response
+// and the identity of the authenticated user, if known.
+func authenticate(r *http.Request, conf *DomainConfig) (bool, int, string) {
 	if conf.AuthPlugin == "" {
 		Debugf("Loading basicAuth")
 		r.Header.Set("AUTH_TYPE", "Basic")
@@ -119,12 +127,12 @@ func authenticate(r *http.Request, conf *DomainConfig) (bool, int) {
 	Debugf("Loading auth plugin")
 	auth := r.Header.Get("Authorization")
 	Debugf("Auth %s", auth)
-	p, err := GetAuthPlugin(conf.AuthPlugin)
+	p, err := GetAuthUserPlugin(conf.AuthPlugin)
 	if err != nil {
 		Errorf(
 			"Error gettting auth plugin %s. Not authenticating. %s",
 			conf.AuthPlugin, err.Error())
-		return false, 500
+		return false, 500, ""
 	}
 	ok := false
 	defer func() {
@@ -134,6 +142,27 @@ func authenticate(r *http.Request, conf *DomainConfig) (bool, int) {
 	}()
 	domain := getDomainForRequest(r)
 	Debugf("Got domain %s for request", domain)
-	ok, status := p(r, domain, &conf.AuthPluginConf)
-	return ok, status
+	ok, status, user := p(r, domain, &conf.AuthPluginConf)
+	return ok, status, user
+}
+
+type ctxKey int
+
+const userCtxKey ctxKey = iota
+
+// withUser returns a copy of the request with the identity of the
+// authenticated user in its context.
+func withUser(r *http.Request, user string) *http.Request {
+	if user == "" {
+		return r
+	}
+	ctx := context.WithValue(r.Context(), userCtxKey, user)
+	return r.WithContext(ctx)
+}
+
+// requestUser returns the identity of the user authenticated in the
+// request or an empty string if there is no authenticated user.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userCtxKey).(string)
+	return user
 }
@@ -91,7 +91,7 @@ func TestAuthenticate_BasicAuth(t *testing.T) {
 		conf.HtpasswdFile = test.fpath
 
 		req.SetBasicAuth(test.user, test.password)
-		r, _ := authenticate(req, &conf)
+		r, _, _ := authenticate(req, &conf)
 
 		if r != test.ok {
 			t.Errorf("error in %s %s: %t", test.user, test.password, r)
@@ -120,10 +120,35 @@ func TestAuthenticate_Plugin(t *testing.T) {
 		conf := DomainConfig{}
 		conf.AuthPlugin = test.fpath
 		req.Host = test.host
-		r, _ := authenticate(req, &conf)
+		r, _, _ := authenticate(req, &conf)
 
 		if r != test.ok {
 			t.Errorf("error in %s: %t", test.host, r)
 		}
 	}
 }
+
+func TestAuthenticate_PluginUser(t *testing.T) {
+	fpath := "./build/auth_user_plugin.so"
+	err := LoadAuthPlugin(fpath, "domain", nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var tests = []struct {
+		user string
+		ok   bool
+	}{
+		{"chico", true},
+		{"", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/u/", nil)
+		req.Header.Set("X-User", test.user)
+		conf := DomainConfig{}
+		conf.AuthPlugin = fpath
+		ok, _, user := authenticate(req, &conf)
+		if ok != test.ok || user != test.user {
+			t.Errorf("error in %s: %t %s", test.user, ok, user)
+		}
+	}
+}
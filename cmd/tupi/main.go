@@ -9,54 +9,169 @@ Usage:
 
 The params are:
 
+		 -allow-put
+			 Accepts authenticated PUT requests with the raw file content
+
 		 -certfile string
 			 Path for the tls certificate file
 
+		 -compress
+			 Serves gzip encoded files when the client accepts gzip
+
+		 -compress-min-size int
+			 Min size in bytes of the files compressed on the fly (default 1024)
+
 		 -conf string
 			 Path for the configuration file
 
 		 -default-to-index
 			 Returns the index.html instead of listing a directory
 
+		 -default-ttl int
+			 Time in seconds before uploaded files expire. Never expire if 0
+
+		 -deploy-releases int
+			 Deploys extracted archives as releases and keeps this many releases. Disabled if 0
+
+		 -dir-list-limit int
+			 Max number of entries in each page of the directory listings. No limit if 0
+
+		 -dir-list-template string
+			 Path of a html template file for the directory listings
+
 		 -epath string
 			 Path to extract files (default "/e/")
 
+		 -extract-preserve-links
+			 Recreates the hard links of the archives instead of copying the files
+
+		 -extract-preserve-mode
+			 Applies the mode of the archive entries to the extracted files
+
+		 -extract-preserve-mtime
+			 Applies the modification time of the archive entries to the extracted files
+
+		 -extract-umask int
+			 Mask for the mode of the extracted files (default 18)
+
+		 -file-naming string
+			 How uploaded files are named: original, random, hash or a template (default "original")
+
 		 -host string
 			 host to listen. (default "0.0.0.0")
 
 		 -htpasswd string
 			 Full path for a htpasswd file used for authentication
 
+		 -keep-versions int
+			 How many previous versions of overwritten files are kept
+
 		 -keyfile string
 			 Path for the tls key file
 
 		-loglevel string
 		   Log level (default "info")
 
+		 -max-compression-ratio int
+			 Max ratio between the extracted size and the archive size. No limit if 0 (default 200)
+
+		 -max-extract-entries int
+			 Max number of entries in an extracted archive. No limit if 0 (default 100000)
+
+		 -max-extract-size int
+			 Max size in bytes of the files extracted from an archive. No limit if 0 (default 1073741824)
+
 		 -maxupload int
 			 Max size for uploaded files (default 10485760)
 
+		 -on-collision string
+			 What to do when an uploaded file exists: error, overwrite or suffix
+
 		 -port int
 			 port to listen. (default 8080)
 
 		 -prevent-overwrite
 			Prevents over writing existent files
 
+		 -quota-bytes int
+			 Max size in bytes of all stored files. No limit if 0
+
+		 -quota-files int
+			 Max number of stored files. No limit if 0
+
+		 -quota-per-user
+			 Applies the quota to each user dir instead of the root dir
+
+		 -rollback-path string
+			 Path to list and roll back releases. Disabled if empty
+
 		 -root string
 			 The directory to serve files from (default ".")
 
+		 -signing-secret string
+			 Secret used to sign urls. Signed urls are disabled if empty
+
 		 -timeout int
 			 Timeout in seconds for read/write (default 240)
 
+		 -tus-expiration int
+			 Time in seconds before an unfinished resumable upload expires (default 86400)
+
+		 -tuspath string
+			 Path for resumable uploads using the tus protocol. Disabled if empty
+
 		 -upath string
 			 Path to upload files (default "/u/")
 
+		 -upload-allow-ext string
+			 A comma separated list of file extensions allowed in uploads
+
+		 -upload-allow-types string
+			 A comma separated list of content types allowed in uploads
+
+		 -upload-deny-ext string
+			 A comma separated list of file extensions denied in uploads
+
+		 -upload-deny-types string
+			 A comma separated list of content types denied in uploads
+
+		 -usage-path string
+			 Path that informs the disk usage. Disabled if empty
+
+		 -user-dirs
+			 Stores uploaded files in a directory for each authenticated user
+
 	     -loglevel string
 	         Log level for the running instance
 
 Only authenticated uploads are allowed. To upload a file one need to use
 an authentication method. Check the [online documentation] for details.
 
+Signed urls, that don't need authentication, are created with the sign
+command:
+
+	tupi sign [params]
+
+The params are:
+
+		 -conf string
+			 Path for the configuration file with the signing secret
+
+		 -domain string
+			 Domain in the configuration file (default "default")
+
+		 -expires int
+			 Time in seconds before the url expires (default 3600)
+
+		 -method string
+			 Http method allowed by the url: GET, HEAD, PUT or DELETE (default "GET")
+
+		 -path string
+			 Path, with an optional query string, of the url
+
+		 -secret string
+			 Secret used to sign the url
+
 [online documentation]: https://tupi.poraodojuca.dev
 */
 package main
@@ -64,12 +179,19 @@ package main
 // notest
 
 import (
+	"flag"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/jucacrispim/tupi"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		sign(os.Args[2:])
+		return
+	}
 	conf, err := tupi.GetConfig()
 	if err != nil {
 		panic("Bad config " + err.Error())
@@ -83,3 +205,38 @@ func main() {
 	server := tupi.SetupServer(conf)
 	server.Run()
 }
+
+// sign prints a signed url
+func sign(args []string) {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	secret := flags.String("secret", "", "Secret used to sign the url")
+	confPath := flags.String("conf", "",
+		"Path for the configuration file with the signing secret")
+	domain := flags.String("domain", "default", "Domain in the configuration file")
+	method := flags.String("method", "GET",
+		"Http method allowed by the url: GET, HEAD, PUT or DELETE")
+	path := flags.String("path", "", "Path, with an optional query string, of the url")
+	expires := flags.Int("expires", 3600, "Time in seconds before the url expires")
+	flags.Parse(args)
+
+	if *secret == "" && *confPath != "" {
+		conf, err := tupi.GetConfigFromFile(*confPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Bad config "+err.Error())
+			os.Exit(1)
+		}
+		dconf, exists := conf.Domains[*domain]
+		if !exists || dconf.SigningSecret == "" {
+			dconf = conf.Domains["default"]
+		}
+		*secret = dconf.SigningSecret
+	}
+
+	exp := time.Now().Add(time.Duration(*expires) * time.Second)
+	u, err := tupi.SignURL(*secret, *method, *path, exp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(u)
+}
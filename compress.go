@@ -0,0 +1,176 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// precompressed files are kept next to the original file
+// with this suffix, like `app.js.gz`.
+const gzipSuffix = ".gz"
+
+// compressOptions are the options to compress the served files.
+type compressOptions struct {
+	enabled bool
+	// min size of the files compressed on the fly
+	minSize int64
+}
+
+func newCompressOptions(c *DomainConfig) compressOptions {
+	return compressOptions{enabled: c.Compress, minSize: valueOf(c.CompressMinSize)}
+}
+
+// acceptsGzip informs if the client accepts gzip encoded responses.
+// An explicit gzip coding has precedence over `*`.
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(v, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if _, qv, found := strings.Cut(strings.ReplaceAll(params, " ", ""), "q="); found {
+			var err error
+			q, err = strconv.ParseFloat(qv, 64)
+			if err != nil {
+				q = 0
+			}
+		}
+		switch coding {
+		case "gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// isCompressible informs if it is worth to compress a content type.
+func isCompressible(ctype string) bool {
+	mtype, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mtype, "text/") ||
+		strings.HasSuffix(mtype, "+json") || strings.HasSuffix(mtype, "+xml") {
+		return true
+	}
+	switch mtype {
+	case "application/javascript", "application/json", "application/xml",
+		"application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// fileContentType returns the content type of a file based in its
+// name or, if the extension is unknown, in its first bytes.
+func fileContentType(name string, f io.ReadSeeker) (string, error) {
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype != "" {
+		return ctype, nil
+	}
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	ctype = http.DetectContentType(buf[:n])
+	_, err := f.Seek(0, io.SeekStart)
+	return ctype, err
+}
+
+// serveCompressed serves a gzip encoded response for the file `f` if
+// the client accepts it. A precompressed `.gz` file next to `f` is
+// preferred. Otherwise compressible files bigger than the min size are
+// compressed on the fly, unless the request has a Range header, as the
+// ranges would be of the compressed content. Returns false if the
+// response was not served.
+func serveCompressed(w http.ResponseWriter, r *http.Request, fsys http.FileSystem,
+	name string, d fs.FileInfo, f http.File, opts compressOptions) bool {
+	if !opts.enabled {
+		return false
+	}
+	// the response depends on the Accept-Encoding even if it is not
+	// compressed.
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) || strings.HasSuffix(name, gzipSuffix) {
+		return false
+	}
+	ctype, err := fileContentType(name, f)
+	if err != nil {
+		// notest
+		return false
+	}
+
+	gz, err := fsys.Open(name + gzipSuffix)
+	if err == nil {
+		defer gz.Close()
+		gzInfo, err := gz.Stat()
+		// an outdated sidecar is not used
+		if err == nil && gzInfo.Mode().IsRegular() && !gzInfo.ModTime().Before(d.ModTime()) {
+			// the sidecar is a different representation so it has
+			// its own etag.
+			if etag := httpFileETag(fsys, name+gzipSuffix, gz, gzInfo); etag != "" {
+				w.Header().Set("ETag", etag)
+			} else {
+				w.Header().Del("ETag")
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.Header().Set("Content-Encoding", "gzip")
+			http.ServeContent(w, r, name, d.ModTime(), gz)
+			return true
+		}
+	}
+
+	if r.Header.Get("Range") != "" || d.Size() < opts.minSize || !isCompressible(ctype) {
+		return false
+	}
+	// the compressed content may change with the compression
+	// library so its etag is weak.
+	etag := w.Header().Get("ETag")
+	if etag != "" {
+		etag = "W/" + etag
+		w.Header().Set("ETag", etag)
+	}
+	if checkPreconditions(w, r, etag, d.ModTime()) {
+		return true
+	}
+	setLastModified(w, d.ModTime())
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	gw := gzip.NewWriter(w)
+	_, err = io.Copy(gw, f)
+	if err == nil {
+		err = gw.Close()
+	}
+	if err != nil {
+		// notest
+		Errorf("error compressing %s: %s\n", name, err.Error())
+	}
+	return true
+}
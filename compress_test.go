@@ -0,0 +1,181 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	var tests = []struct {
+		header string
+		accept bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"br, GZIP", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"*;q=1, gzip;q=0", false},
+		{"identity", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", test.header)
+		if acceptsGzip(req) != test.accept {
+			t.Errorf("bad accept for %q", test.header)
+		}
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	var tests = []struct {
+		ctype        string
+		compressible bool
+	}{
+		{"text/css; charset=utf-8", true},
+		{"text/javascript; charset=utf-8", true},
+		{"application/json", true},
+		{"application/ld+json", true},
+		{"image/svg+xml", true},
+		{"image/png", false},
+		{"application/gzip", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if isCompressible(test.ctype) != test.compressible {
+			t.Errorf("bad compressible for %q", test.ctype)
+		}
+	}
+}
+
+func gzipBytes(content string) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	gw.Write([]byte(content))
+	gw.Close()
+	return buf.Bytes()
+}
+
+func gunzipBytes(b []byte) string {
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return ""
+	}
+	c, _ := io.ReadAll(gr)
+	return string(c)
+}
+
+func TestShowFile_Compress(t *testing.T) {
+	rdir := "/tmp/tupitest-compress"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	css := strings.Repeat("body {color: red;}\n", 100)
+	old := time.Now().Add(-time.Hour)
+	os.WriteFile(filepath.Join(rdir, "app.js"), []byte("var a = 1;"), 0644)
+	os.WriteFile(filepath.Join(rdir, "app.js.gz"), gzipBytes("var sidecar = 1;"), 0644)
+	os.WriteFile(filepath.Join(rdir, "style.css"), []byte(css), 0644)
+	os.WriteFile(filepath.Join(rdir, "small.txt"), []byte("small"), 0644)
+	os.WriteFile(filepath.Join(rdir, "image.png"), []byte(css), 0644)
+	os.WriteFile(filepath.Join(rdir, "data.json.gz"), gzipBytes("stale"), 0644)
+	os.Chtimes(filepath.Join(rdir, "data.json.gz"), old, old)
+	os.WriteFile(filepath.Join(rdir, "data.json"), []byte(css), 0644)
+
+	var tests = []struct {
+		compress bool
+		path     string
+		headers  map[string]string
+		status   int
+		encoding string
+		body     string
+	}{
+		{true, "/app.js", map[string]string{"Accept-Encoding": "gzip"},
+			200, "gzip", "var sidecar = 1;"},
+		{true, "/app.js", map[string]string{}, 200, "", "var a = 1;"},
+		{true, "/style.css", map[string]string{"Accept-Encoding": "gzip"},
+			200, "gzip", css},
+		{true, "/style.css", map[string]string{
+			"Accept-Encoding": "gzip", "Range": "bytes=0-3"},
+			206, "", css[:4]},
+		{true, "/style.css", map[string]string{
+			"Accept-Encoding":   "gzip",
+			"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)},
+			304, "", ""},
+		{true, "/small.txt", map[string]string{"Accept-Encoding": "gzip"},
+			200, "", "small"},
+		{true, "/image.png", map[string]string{"Accept-Encoding": "gzip"},
+			200, "", css},
+		{true, "/data.json", map[string]string{"Accept-Encoding": "gzip"},
+			200, "gzip", css},
+		{false, "/style.css", map[string]string{"Accept-Encoding": "gzip"},
+			200, "", css},
+	}
+	minSize := int64(1024)
+	for _, test := range tests {
+		dconf := DomainConfig{
+			Port:            8000,
+			RootDir:         rdir,
+			DefaultToIndex:  new(bool),
+			Compress:        test.compress,
+			CompressMinSize: &minSize,
+		}
+		conf := Config{}
+		conf.Domains = make(map[string]DomainConfig)
+		conf.Domains["default"] = dconf
+		server := SetupServer(conf)
+
+		req, _ := http.NewRequest("GET", test.path, nil)
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("got %d, expected %d for %s", w.Code, test.status, test.path)
+		}
+		encoding := w.Header().Get("Content-Encoding")
+		if encoding != test.encoding {
+			t.Fatalf("bad encoding %q for %s", encoding, test.path)
+		}
+		body := w.Body.String()
+		if encoding == "gzip" {
+			body = gunzipBytes(w.Body.Bytes())
+			if w.Header().Get("Content-Type") == "application/gzip" {
+				t.Fatalf("bad content type for %s", test.path)
+			}
+		}
+		if body != test.body {
+			t.Fatalf("bad body %q for %s", body, test.path)
+		}
+		vary := w.Header().Get("Vary")
+		if (vary == "Accept-Encoding") != test.compress {
+			t.Fatalf("bad vary %q for %s", vary, test.path)
+		}
+	}
+}
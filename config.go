@@ -57,7 +57,72 @@ type DomainConfig struct {
 	LogLevel         string
 	PreventOverwrite bool
 	AuthMethods      []string
-	redirToHttps     bool
+	TusPath          string
+	TusExpiration    *int
+	AllowPut         bool
+	// Rules for the types of uploaded files. Extensions are checked
+	// against the file name and types against the content type
+	// sniffed from the first bytes of the file.
+	UploadAllowExtensions []string
+	UploadDenyExtensions  []string
+	UploadAllowTypes      []string
+	UploadDenyTypes       []string
+	// Stores the uploaded files in a directory named after the
+	// authenticated user.
+	UserDirs bool
+	// How uploaded files are named: original, random, hash or
+	// a template like `{yyyy}/{mm}/{uuid}{ext}`.
+	FileNaming *string
+	// What to do when an uploaded file already exists: error,
+	// overwrite or suffix. If empty PreventOverwrite is used.
+	OnCollision *string
+	// Limits for the total size and number of files in the root dir.
+	// With QuotaPerUser the limits are for each user dir.
+	QuotaBytes   int64
+	QuotaFiles   int64
+	QuotaPerUser bool
+	// Path that informs the disk usage. Disabled if empty.
+	UsagePath string
+	// How many previous versions of the overwritten files are kept.
+	// Disabled if 0.
+	KeepVersions int
+	// Time in seconds before uploaded files expire. Files don't expire
+	// if 0, unless the upload says so.
+	DefaultTTL int
+	// Secret used to sign urls. Signed urls are disabled if empty.
+	SigningSecret string
+	// Archives sent to the extract path are deployed as releases and
+	// the root dir is a link to the current release. How many releases
+	// are kept. Disabled if 0.
+	DeployReleases int
+	// Path that lists the releases and rolls back to one of them.
+	// Disabled if empty.
+	RollbackPath string
+	// Limits for the extracted archives: the total size of the
+	// extracted files, the number of entries and the extracted size
+	// divided by the size of the archive. No limit if 0.
+	MaxExtractSize      *int64
+	MaxExtractEntries   *int64
+	MaxCompressionRatio *int64
+	// What is kept from the headers of the extracted archives. The mode
+	// is masked by ExtractUmask and hard links are recreated inside
+	// the root dir instead of copied.
+	ExtractPreserveMode  bool
+	ExtractUmask         *int
+	ExtractPreserveMtime bool
+	ExtractPreserveLinks bool
+	// Serves the precompressed `.gz` files and compresses the responses
+	// when the client accepts gzip. Only files with at least
+	// CompressMinSize bytes are compressed on the fly.
+	Compress        bool
+	CompressMinSize *int64
+	// Path of a html/template file used for the directory listings.
+	// The default listing is used if empty.
+	DirListTemplate string
+	// Max number of entries in each page of the directory listings.
+	// No limit if 0.
+	DirListLimit int
+	redirToHttps bool
 }
 
 // HasCert informs if the DomainConfig has a ssl certificate file path
@@ -86,6 +151,17 @@ func (c *DomainConfig) HasPortConf(port int) bool {
 	return false
 }
 
+// isAuthMethod informs if requests using a http method must be
+// authenticated.
+func (c *DomainConfig) isAuthMethod(method string) bool {
+	for _, meth := range c.AuthMethods {
+		if strings.ToUpper(meth) == strings.ToUpper(method) {
+			return true
+		}
+	}
+	return false
+}
+
 // Validate validates the ports config looking for duplicated configs
 // and if the required ssl configs are present
 func (c *DomainConfig) Validate() error {
@@ -117,7 +193,22 @@ func (c *DomainConfig) Validate() error {
 	if (has_cert || has_key) && !(has_cert && has_key) {
 		return errors.New("You must pass certfile and certkey to use ssl")
 	}
-	return nil
+	if c.QuotaPerUser && !c.UserDirs {
+		return errors.New("QuotaPerUser requires UserDirs")
+	}
+	if c.DeployReleases > 0 && c.UserDirs {
+		return errors.New("DeployReleases can't be used with UserDirs")
+	}
+	if c.RollbackPath != "" && c.DeployReleases <= 0 {
+		return errors.New("RollbackPath requires DeployReleases")
+	}
+	if c.DirListTemplate != "" {
+		_, err := listTemplate(c.DirListTemplate)
+		if err != nil {
+			return errors.New("Bad DirListTemplate: " + err.Error())
+		}
+	}
+	return validateNaming(valueOf(c.FileNaming), valueOf(c.OnCollision))
 }
 
 // Config is the config all domains. The default config is the config in
@@ -241,6 +332,66 @@ func GetConfigFromCommandLine() DomainConfig {
 		"Prevents over writing existent files")
 	authMethods := flag.String("auth-methods", "POST",
 		"A comma separeted list of http methods that must be authenticated")
+	tusPath := flag.String("tuspath", "",
+		"Path for resumable uploads using the tus protocol. Disabled if empty")
+	tusExpiration := flag.Int("tus-expiration", 86400,
+		"Time in seconds before an unfinished resumable upload expires")
+	allowPut := flag.Bool("allow-put", false,
+		"Accepts authenticated PUT requests with the raw file content")
+	allowExts := flag.String("upload-allow-ext", "",
+		"A comma separated list of file extensions allowed in uploads")
+	denyExts := flag.String("upload-deny-ext", "",
+		"A comma separated list of file extensions denied in uploads")
+	allowTypes := flag.String("upload-allow-types", "",
+		"A comma separated list of content types allowed in uploads")
+	denyTypes := flag.String("upload-deny-types", "",
+		"A comma separated list of content types denied in uploads")
+	userDirs := flag.Bool("user-dirs", false,
+		"Stores uploaded files in a directory for each authenticated user")
+	fileNaming := flag.String("file-naming", "original",
+		"How uploaded files are named: original, random, hash or a template")
+	onCollision := flag.String("on-collision", "",
+		"What to do when an uploaded file exists: error, overwrite or suffix")
+	quotaBytes := flag.Int64("quota-bytes", 0,
+		"Max size in bytes of all stored files. No limit if 0")
+	quotaFiles := flag.Int64("quota-files", 0,
+		"Max number of stored files. No limit if 0")
+	quotaPerUser := flag.Bool("quota-per-user", false,
+		"Applies the quota to each user dir instead of the root dir")
+	usagePath := flag.String("usage-path", "",
+		"Path that informs the disk usage. Disabled if empty")
+	keepVersions := flag.Int("keep-versions", 0,
+		"How many previous versions of overwritten files are kept")
+	defaultTTL := flag.Int("default-ttl", 0,
+		"Time in seconds before uploaded files expire. Never expire if 0")
+	signingSecret := flag.String("signing-secret", "",
+		"Secret used to sign urls. Signed urls are disabled if empty")
+	deployReleases := flag.Int("deploy-releases", 0,
+		"Deploys extracted archives as releases and keeps this many releases. Disabled if 0")
+	rollbackPath := flag.String("rollback-path", "",
+		"Path to list and roll back releases. Disabled if empty")
+	maxExtractSize := flag.Int64("max-extract-size", 1<<30,
+		"Max size in bytes of the files extracted from an archive. No limit if 0")
+	maxExtractEntries := flag.Int64("max-extract-entries", 100000,
+		"Max number of entries in an extracted archive. No limit if 0")
+	maxCompressionRatio := flag.Int64("max-compression-ratio", 200,
+		"Max ratio between the extracted size and the archive size. No limit if 0")
+	extractPreserveMode := flag.Bool("extract-preserve-mode", false,
+		"Applies the mode of the archive entries to the extracted files")
+	extractUmask := flag.Int("extract-umask", 0022,
+		"Mask for the mode of the extracted files")
+	extractPreserveMtime := flag.Bool("extract-preserve-mtime", false,
+		"Applies the modification time of the archive entries to the extracted files")
+	extractPreserveLinks := flag.Bool("extract-preserve-links", false,
+		"Recreates the hard links of the archives instead of copying the files")
+	compress := flag.Bool("compress", false,
+		"Serves gzip encoded files when the client accepts gzip")
+	compressMinSize := flag.Int64("compress-min-size", 1024,
+		"Min size in bytes of the files compressed on the fly")
+	dirListTemplate := flag.String("dir-list-template", "",
+		"Path of a html template file for the directory listings")
+	dirListLimit := flag.Int("dir-list-limit", 0,
+		"Max number of entries in each page of the directory listings. No limit if 0")
 
 	args := getCmdlineArgs()
 	flag.CommandLine.Parse(args)
@@ -266,10 +417,49 @@ func GetConfigFromCommandLine() DomainConfig {
 	conf.LogLevel = *logLevel
 	conf.PreventOverwrite = *preventOverwrite
 	conf.AuthMethods = strings.Split(*authMethods, ",")
+	conf.TusPath = *tusPath
+	conf.TusExpiration = tusExpiration
+	conf.AllowPut = *allowPut
+	conf.UploadAllowExtensions = splitList(*allowExts)
+	conf.UploadDenyExtensions = splitList(*denyExts)
+	conf.UploadAllowTypes = splitList(*allowTypes)
+	conf.UploadDenyTypes = splitList(*denyTypes)
+	conf.UserDirs = *userDirs
+	conf.FileNaming = fileNaming
+	conf.OnCollision = onCollision
+	conf.QuotaBytes = *quotaBytes
+	conf.QuotaFiles = *quotaFiles
+	conf.QuotaPerUser = *quotaPerUser
+	conf.UsagePath = *usagePath
+	conf.KeepVersions = *keepVersions
+	conf.DefaultTTL = *defaultTTL
+	conf.SigningSecret = *signingSecret
+	conf.DeployReleases = *deployReleases
+	conf.RollbackPath = *rollbackPath
+	conf.MaxExtractSize = maxExtractSize
+	conf.MaxExtractEntries = maxExtractEntries
+	conf.MaxCompressionRatio = maxCompressionRatio
+	conf.ExtractPreserveMode = *extractPreserveMode
+	conf.ExtractUmask = extractUmask
+	conf.ExtractPreserveMtime = *extractPreserveMtime
+	conf.ExtractPreserveLinks = *extractPreserveLinks
+	conf.Compress = *compress
+	conf.CompressMinSize = compressMinSize
+	conf.DirListTemplate = *dirListTemplate
+	conf.DirListLimit = *dirListLimit
 
 	return conf
 }
 
+// splitList splits a comma separated list from the command line.
+// An empty string is an empty list.
+func splitList(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
 func GetConfigFromFile(fpath string) (Config, error) {
 	bytes, error := os.ReadFile(fpath)
 	if error != nil {
@@ -292,6 +482,11 @@ func GetConfigFromFile(fpath string) (Config, error) {
 
 // merge two confs together. confA has precedence over confB
 func mergeConfs(confA DomainConfig, confB DomainConfig) DomainConfig {
+	// PreventOverwrite is only used without OnCollision so the
+	// OnCollision of confB can't override it.
+	if confA.PreventOverwrite && confA.OnCollision == nil {
+		confB.OnCollision = nil
+	}
 	valA := reflect.ValueOf(confA)
 	valB := reflect.ValueOf(&confB).Elem()
 	for i := 0; i < valA.NumField(); i++ {
@@ -306,6 +501,16 @@ func mergeConfs(confA DomainConfig, confB DomainConfig) DomainConfig {
 	return confB
 }
 
+// valueOf returns the value of an optional config or its zero value
+// if it is not set.
+func valueOf[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
+
 // what we do here is a kind of hack before sending
 // the config to the toml parser.
 // First we split the contents in different sections (marked by a
@@ -20,6 +20,7 @@ package tupi
 import (
 	"flag"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -170,6 +171,23 @@ func TestGetConfig_FromFile_MultipleDomains(t *testing.T) {
 	if conf.Domains["other.domain"].Host != "4.4.4.4" {
 		t.Fatalf("Bad host GetConfigFromFile %s", conf.Domains["other.domain"].Host)
 	}
+
+	// the values set to zero are kept and the defaults are used
+	// only when nothing is set.
+	other := conf.Domains["other.domain"]
+	if valueOf(other.MaxExtractSize) != 0 {
+		t.Fatalf("bad maxExtractSize %d", valueOf(other.MaxExtractSize))
+	}
+	domain := conf.Domains["domain"]
+	if valueOf(domain.MaxExtractSize) != 1<<30 {
+		t.Fatalf("bad default maxExtractSize %d", valueOf(domain.MaxExtractSize))
+	}
+	if collisionPolicy(&other) != collisionSuffix {
+		t.Fatalf("bad collision policy %s", collisionPolicy(&other))
+	}
+	if collisionPolicy(&domain) != collisionError {
+		t.Fatalf("onCollision overrides preventOverwrite")
+	}
 }
 
 func TestGetConfig_FromFile_EnvVar(t *testing.T) {
@@ -237,6 +255,62 @@ func TestValidate_WithCertAndKeyFile(t *testing.T) {
 	}
 }
 
+func TestValidate_BadFileNaming(t *testing.T) {
+	naming := "{yyyy}/{nope}"
+	config := DomainConfig{
+		FileNaming: &naming,
+	}
+	c := Config{}
+	c.Domains = make(map[string]DomainConfig)
+	c.Domains["default"] = config
+	if c.Validate() == nil {
+		t.Fatalf("It says the config is valid with bad file naming")
+	}
+}
+
+func TestValidate_Releases(t *testing.T) {
+	var tests = []struct {
+		config DomainConfig
+		valid  bool
+	}{
+		{DomainConfig{DeployReleases: 2, RollbackPath: "/r/"}, true},
+		{DomainConfig{DeployReleases: 2, UserDirs: true}, false},
+		{DomainConfig{RollbackPath: "/r/"}, false},
+	}
+	for _, test := range tests {
+		err := test.config.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("bad validation for %+v: %v", test.config, err)
+		}
+	}
+}
+
+func TestValidate_DirListTemplate(t *testing.T) {
+	tdir := "/tmp/tupitest-template"
+	os.MkdirAll(tdir, 0755)
+	defer os.RemoveAll(tdir)
+	good := filepath.Join(tdir, "good.html")
+	os.WriteFile(good, []byte("{{range .Entries}}{{.Name}}{{end}}"), 0644)
+	bad := filepath.Join(tdir, "bad.html")
+	os.WriteFile(bad, []byte("{{range .Entries}}"), 0644)
+	var tests = []struct {
+		tmpl  string
+		valid bool
+	}{
+		{"", true},
+		{good, true},
+		{bad, false},
+		{filepath.Join(tdir, "missing.html"), false},
+	}
+	for _, test := range tests {
+		c := DomainConfig{DirListTemplate: test.tmpl}
+		err := c.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("bad validation for %s: %v", test.tmpl, err)
+		}
+	}
+}
+
 func TestValidate_DuplicatedPortConfig(t *testing.T) {
 	config := DomainConfig{
 		Ports: []PortConfig{
@@ -0,0 +1,249 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const NO_RELEASE_MSG = "Release not found"
+const NOT_RELEASE_ROOT_MSG = "The root dir is not a link to a release"
+
+// The releases of a root dir are kept in a sibling dir, so
+// `/var/www/site` has its releases in `/var/www/site.releases`.
+const releasesDirSuffix = ".releases"
+
+// Release names are timestamps so they sort in the order
+// they were created.
+const releaseTimeFormat = "20060102150405.000000000"
+
+type releasesJSON struct {
+	Current  string   `json:"current"`
+	Releases []string `json:"releases"`
+}
+
+func releasesDir(root string) string {
+	return filepath.Clean(root) + releasesDirSuffix
+}
+
+// isReleaseRoot informs if a root dir can be switched to a release,
+// that is, if it is a symlink or does not exist yet.
+func isReleaseRoot(root string) bool {
+	info, err := os.Lstat(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	return err == nil && info.Mode()&fs.ModeSymlink != 0
+}
+
+// newRelease creates an empty release dir for the root dir.
+func newRelease(root string) (string, error) {
+	dir := releasesDir(root)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	rpath := filepath.Join(dir, time.Now().UTC().Format(releaseTimeFormat))
+	err = os.Mkdir(rpath, 0755)
+	if err != nil {
+		return "", err
+	}
+	return rpath, nil
+}
+
+// listReleases returns the names of the releases of the root dir,
+// from the oldest to the newest.
+func listReleases(root string) ([]string, error) {
+	entries, err := os.ReadDir(releasesDir(root))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// notest
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// currentRelease returns the name of the release the root dir
+// links to.
+func currentRelease(root string) string {
+	target, err := os.Readlink(root)
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// switchRelease atomically changes the release the root dir links to.
+// A new link is created and renamed over the root dir so there is no
+// moment where the root dir does not exist.
+func switchRelease(root string, name string) error {
+	AcquireLock(root)
+	defer ReleaseLock(root)
+
+	if !isReleaseRoot(root) {
+		return errors.New(NOT_RELEASE_ROOT_MSG)
+	}
+	// the link is relative so the root dir and its releases
+	// can be moved together.
+	target := filepath.Join(filepath.Base(releasesDir(root)), name)
+	tmp, err := genRandFname(filepath.Base(root))
+	if err != nil {
+		// notest
+		return err
+	}
+	tmp = filepath.Join(filepath.Dir(filepath.Clean(root)), "."+tmp)
+	err = os.Symlink(target, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, root)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// pruneReleases removes the oldest releases keeping at most `keep`
+// releases. The current release is never removed.
+func pruneReleases(root string, keep int) {
+	names, err := listReleases(root)
+	if err != nil {
+		// notest
+		return
+	}
+	current := currentRelease(root)
+	for i := 0; i < len(names)-keep; i++ {
+		if names[i] == current {
+			continue
+		}
+		Debugf("removing release %s", names[i])
+		err := os.RemoveAll(filepath.Join(releasesDir(root), names[i]))
+		if err != nil {
+			// notest
+			Errorf("error removing release %s: %s", names[i], err.Error())
+		}
+	}
+}
+
+// deployArchives extracts the archives in a new release and switches
+// the root dir to it. If anything fails the release is removed and the
+// root dir is not changed.
+func deployArchives(files []*uploadedFile, root string, keep int, opts uploadOptions) ([]uploadResult, error) {
+	if !isReleaseRoot(root) {
+		return nil, errors.New(NOT_RELEASE_ROOT_MSG)
+	}
+	rpath, err := newRelease(root)
+	if err != nil {
+		// notest
+		return nil, err
+	}
+	// the release is a new root dir so there is nothing to version
+	// and the expiry metadata is kept inside the release.
+	opts.versions = nil
+	if opts.expiry != nil {
+		e := *opts.expiry
+		e.root = rpath
+		opts.expiry = &e
+	}
+	results, err := extractUploadedFiles(files, rpath, opts)
+	if err != nil {
+		os.RemoveAll(rpath)
+		return nil, err
+	}
+	err = switchRelease(root, filepath.Base(rpath))
+	if err != nil {
+		os.RemoveAll(rpath)
+		return nil, err
+	}
+	pruneReleases(root, keep)
+	return results, nil
+}
+
+// previousRelease returns the release created before the current one.
+func previousRelease(root string) (string, error) {
+	names, err := listReleases(root)
+	if err != nil {
+		// notest
+		return "", err
+	}
+	current := currentRelease(root)
+	for i := len(names) - 1; i > 0; i-- {
+		if names[i] == current {
+			return names[i-1], nil
+		}
+	}
+	return "", errors.New(NO_RELEASE_MSG)
+}
+
+// serveReleases lists the releases of the root dir on GET and rolls
+// back to one of them on POST. The release is the `release` param
+// of the request or the previous release if the param is empty.
+func serveReleases(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		writeError(w, req, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed,
+			"Method not allowed")
+		return
+	}
+	names, err := listReleases(c.RootDir)
+	if err != nil {
+		// notest
+		writeUploadError(w, req, err)
+		return
+	}
+	if req.Method == http.MethodPost {
+		name := req.FormValue("release")
+		if name == "" {
+			name, err = previousRelease(c.RootDir)
+		} else if !contains(names, name) {
+			err = errors.New(NO_RELEASE_MSG)
+		}
+		if err == nil {
+			err = switchRelease(c.RootDir, name)
+		}
+		if err != nil {
+			writeUploadError(w, req, err)
+			return
+		}
+		Infof("rolled back %s to release %s", c.RootDir, name)
+	}
+	resp := releasesJSON{
+		Current:  currentRelease(c.RootDir),
+		Releases: names,
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func deployTestServer(root string) TupiServer {
+	return setupTestServer(root, func(c *DomainConfig) {
+		c.DeployReleases = 2
+		c.RollbackPath = "/releases/"
+	})
+}
+
+func deployArchive(server TupiServer, fpath string, prefix string) int {
+	b, _ := os.ReadFile(fpath)
+	buf, boundary, _ := createMultiFileBufferReader(
+		[]string{filepath.Base(fpath)}, []string{string(b)}, prefix)
+	req, _ := http.NewRequest("POST", "/e/", buf)
+	req.SetBasicAuth("test", "123")
+	req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+	w := httptest.NewRecorder()
+	server.Servers[0].Server.Handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestDeployArchives(t *testing.T) {
+	dir := "/tmp/tupitest-deploy"
+	root := filepath.Join(dir, "site")
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	server := deployTestServer(root)
+
+	var tests = []struct {
+		fpath  string
+		prefix string
+		status int
+	}{
+		{"./testdata/test.tar.gz", "", 201},
+		{"./testdata/test.zip", "", 201},
+		{"./testdata/test.tar", "", 201},
+		{"./testdata/file.txt", "", 415},
+		{"./testdata/test.tar", "some/dir", 400},
+	}
+	for _, test := range tests {
+		current := currentRelease(root)
+		status := deployArchive(server, test.fpath, test.prefix)
+		if status != test.status {
+			t.Fatalf("got %d, expected %d for %s", status, test.status, test.fpath)
+		}
+		if test.status != 201 {
+			if currentRelease(root) != current {
+				t.Fatalf("release changed after a bad deploy")
+			}
+			continue
+		}
+		if currentRelease(root) == current {
+			t.Fatalf("release not changed after deploy")
+		}
+		if !fileExists(filepath.Join(root, "bla", "one.txt")) {
+			t.Fatalf("file not deployed")
+		}
+	}
+
+	names, _ := listReleases(root)
+	if len(names) != 2 {
+		t.Fatalf("bad releases count %d", len(names))
+	}
+	if names[1] != currentRelease(root) {
+		t.Fatalf("the current release is not the newest")
+	}
+}
+
+func TestDeployArchives_NotReleaseRoot(t *testing.T) {
+	root := "/tmp/tupitest-deploy"
+	os.MkdirAll(root, 0755)
+	defer os.RemoveAll(root)
+	server := deployTestServer(root)
+
+	status := deployArchive(server, "./testdata/test.tar.gz", "")
+	if status != 409 {
+		t.Fatalf("got %d, expected 409", status)
+	}
+	if fileExists(filepath.Join(root, "bla")) {
+		t.Fatalf("files extracted over the root dir")
+	}
+	if fileExists(releasesDir(root)) {
+		names, _ := listReleases(root)
+		if len(names) != 0 {
+			t.Fatalf("release created for a bad root dir")
+		}
+	}
+}
+
+func TestServeReleases(t *testing.T) {
+	dir := "/tmp/tupitest-deploy"
+	root := filepath.Join(dir, "site")
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	server := deployTestServer(root)
+
+	deployArchive(server, "./testdata/test.tar.gz", "")
+	deployArchive(server, "./testdata/test.zip", "")
+	names, _ := listReleases(root)
+
+	var tests = []struct {
+		method  string
+		release string
+		auth    bool
+		status  int
+		current string
+	}{
+		{"GET", "", false, 401, names[1]},
+		{"POST", "", false, 401, names[1]},
+		{"PUT", "", true, 405, names[1]},
+		{"GET", "", true, 200, names[1]},
+		{"POST", "", true, 200, names[0]},
+		// there is no release before the first one
+		{"POST", "", true, 404, names[0]},
+		{"POST", "../site", true, 404, names[0]},
+		{"POST", names[1], true, 200, names[1]},
+	}
+	for _, test := range tests {
+		body := url.Values{"release": {test.release}}.Encode()
+		req, _ := http.NewRequest(test.method, "/releases/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		if test.auth {
+			req.SetBasicAuth("test", "123")
+		}
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("got %d, expected %d for %s %s",
+				w.Code, test.status, test.method, test.release)
+		}
+		if currentRelease(root) != test.current {
+			t.Fatalf("bad current release %s", currentRelease(root))
+		}
+		if w.Code != 200 {
+			continue
+		}
+		var resp releasesJSON
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Current != test.current || len(resp.Releases) != 2 {
+			t.Fatalf("bad response %s", w.Body.String())
+		}
+	}
+}
+
+func TestDiskUsage_ReleaseRoot(t *testing.T) {
+	dir := "/tmp/tupitest-deploy"
+	root := filepath.Join(dir, "site")
+	defer os.RemoveAll(dir)
+	rpath, _ := newRelease(root)
+	os.WriteFile(filepath.Join(rpath, "x.txt"), []byte("123"), 0644)
+	switchRelease(root, filepath.Base(rpath))
+
+	size, count, err := diskUsage(root)
+	if err != nil || size != 3 || count != 1 {
+		t.Fatalf("bad usage %d %d %v", size, count, err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const CHECKSUM_MISMATCH_MSG = "Checksum mismatch"
+const INVALID_DIGEST_MSG = "Invalid digest"
+
+// requestDigest returns the hex encoded sha256 informed by the client
+// in the request headers. Both the Content-Digest (RFC 9530) and the
+// older Digest (RFC 3230) headers are accepted. Returns an empty string
+// if no sha256 was informed.
+func requestDigest(req *http.Request) (string, error) {
+	// Content-Digest: sha-256=:base64:
+	for _, v := range strings.Split(req.Header.Get("Content-Digest"), ",") {
+		alg, val, found := strings.Cut(strings.TrimSpace(v), "=")
+		if !found || strings.ToLower(alg) != "sha-256" {
+			continue
+		}
+		return parseBase64Digest(strings.Trim(val, ":"))
+	}
+
+	// Digest: SHA-256=base64
+	for _, v := range strings.Split(req.Header.Get("Digest"), ",") {
+		alg, val, found := strings.Cut(strings.TrimSpace(v), "=")
+		if !found || strings.ToLower(alg) != "sha-256" {
+			continue
+		}
+		return parseBase64Digest(val)
+	}
+	return "", nil
+}
+
+func parseBase64Digest(v string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(b) != 32 {
+		return "", errors.New(INVALID_DIGEST_MSG)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseHexDigest validates a hex encoded sha256 and returns it
+// lower cased.
+func parseHexDigest(v string) (string, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != 32 {
+		return "", errors.New(INVALID_DIGEST_MSG)
+	}
+	return v, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequestDigest(t *testing.T) {
+	// sha256 of "oi"
+	b64 := "h/YzY0zEsC9ihoVlHwopt7+iKgvYQfclxnct0ApY1Ik="
+	hexsum := "87f633634cc4b02f628685651f0a29b7bfa22a0bd841f725c6772dd00a58d489"
+	var tests = []struct {
+		header  string
+		value   string
+		digest  string
+		has_err bool
+	}{
+		{"Content-Digest", "sha-256=:" + b64 + ":", hexsum, false},
+		{"Content-Digest", "sha-512=:abc:, sha-256=:" + b64 + ":", hexsum, false},
+		{"Content-Digest", "sha-512=:abc:", "", false},
+		{"Content-Digest", "sha-256=:abc:", "", true},
+		{"Digest", "SHA-256=" + b64, hexsum, false},
+		{"Digest", "MD5=abc", "", false},
+		{"X-Other", "bla", "", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/u/", nil)
+		req.Header.Set(test.header, test.value)
+		digest, err := requestDigest(req)
+		if (err != nil) != test.has_err {
+			t.Errorf("Bad error for %s: %v", test.value, err)
+		}
+		if digest != test.digest {
+			t.Errorf("Bad digest for %s: %s", test.value, digest)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+)
+
+const PRECONDITION_FAILED_MSG = "Precondition failed"
+
+// max number of etags kept in memory. When it is reached the
+// cache starts again empty.
+const maxETagCacheSize = 10000
+
+// etagEntry is the cached etag of a file. The etag is valid while the
+// file is the same one, with the same size and modification time.
+type etagEntry struct {
+	info fs.FileInfo
+	etag string
+}
+
+func (e etagEntry) isValid(info fs.FileInfo) bool {
+	return os.SameFile(e.info, info) && e.info.Size() == info.Size() &&
+		e.info.ModTime().Equal(info.ModTime())
+}
+
+var etagCache = struct {
+	sync.Mutex
+	m map[string]etagEntry
+}{m: make(map[string]etagEntry)}
+
+// quoteETag returns the strong etag for the hex encoded sha256 of a
+// file content.
+func quoteETag(sum string) string {
+	return `"` + sum + `"`
+}
+
+// fileETag returns the etag for the file in `fpath`. The etag is the
+// sha256 of the file content. `f` is read only if the etag is not
+// in the cache and it is left at its start.
+func fileETag(fpath string, f io.ReadSeeker, info fs.FileInfo) (string, error) {
+	etagCache.Lock()
+	e, ok := etagCache.m[fpath]
+	etagCache.Unlock()
+	if ok && e.isValid(info) {
+		return e.etag, nil
+	}
+
+	h := sha256.New()
+	_, err := io.Copy(h, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return "", err
+	}
+	etag := quoteETag(hex.EncodeToString(h.Sum(nil)))
+
+	etagCache.Lock()
+	defer etagCache.Unlock()
+	if len(etagCache.m) >= maxETagCacheSize {
+		etagCache.m = make(map[string]etagEntry)
+	}
+	etagCache.m[fpath] = etagEntry{info: info, etag: etag}
+	return etag, nil
+}
+
+// pathETag returns the etag of the file in `fpath` or an empty string
+// if the file does not exist. Directories have no etag.
+func pathETag(fpath string) (string, error) {
+	f, err := os.Open(fpath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		// notest
+		return "", err
+	}
+	if info.IsDir() {
+		return "", nil
+	}
+	return fileETag(fpath, f, info)
+}
+
+// httpFileETag returns the etag of the file `name` opened from `fsys`.
+// Only the files of a http.Dir have etags as the cache is keyed by
+// the file path.
+func httpFileETag(fsys http.FileSystem, name string, f http.File, info fs.FileInfo) string {
+	fpath := httpFilePath(fsys, name)
+	if fpath == "" {
+		return ""
+	}
+	etag, err := fileETag(fpath, f, info)
+	if err != nil {
+		// notest
+		Errorf("error computing etag for %s: %s\n", fpath, err.Error())
+		return ""
+	}
+	return etag
+}
+
+// scanETag determines if a syntactically valid ETag is present at s. If so,
+// the ETag and remaining text after consuming ETag is returned. Otherwise,
+// it returns "", "".
+func scanETag(s string) (etag string, remain string) {
+	s = textproto.TrimString(s)
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
+	}
+	// ETag is either W/"text" or "text".
+	// See RFC 7232 2.3.
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		// Character values allowed in ETags.
+		case c == 0x21 || c >= 0x23 && c <= 0x7E || c >= 0x80:
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+// etagStrongMatch reports whether a and b match using strong ETag comparison.
+// Assumes a and b are valid ETags.
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != "" && a[0] == '"'
+}
+
+// etagWeakMatch reports whether a and b match using weak ETag comparison.
+// Assumes a and b are valid ETags.
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// etagListMatches informs if any of the etags in the header value `list`
+// matches `etag`. An empty `etag` means the file does not exist
+// and matches only `*`.
+func etagListMatches(list string, etag string, match func(a, b string) bool) bool {
+	for {
+		list = textproto.TrimString(list)
+		if len(list) == 0 {
+			return false
+		}
+		if list[0] == ',' {
+			list = list[1:]
+			continue
+		}
+		if list[0] == '*' {
+			return etag != ""
+		}
+		tag, remain := scanETag(list)
+		if tag == "" {
+			return false
+		}
+		if etag != "" && match(tag, etag) {
+			return true
+		}
+		list = remain
+	}
+}
+
+// checkIfMatch checks the `If-Match` header value `im` against the etag
+// of a file. See https://tools.ietf.org/html/rfc7232 section 3.1.
+func checkIfMatch(im string, etag string) condResult {
+	if im == "" {
+		return condNone
+	}
+	if etagListMatches(im, etag, etagStrongMatch) {
+		return condTrue
+	}
+	return condFalse
+}
+
+// checkIfNoneMatch checks the `If-None-Match` header value `inm`
+// against the etag of a file. See https://tools.ietf.org/html/rfc7232
+// section 3.2.
+func checkIfNoneMatch(inm string, etag string) condResult {
+	if inm == "" {
+		return condNone
+	}
+	if etagListMatches(inm, etag, etagWeakMatch) {
+		return condFalse
+	}
+	return condTrue
+}
+
+// preconditions are the conditional headers of an upload request.
+// They are checked against the file that will be overwritten
+// so clients can avoid lost updates.
+type preconditions struct {
+	ifMatch     string
+	ifNoneMatch string
+}
+
+func requestPreconditions(req *http.Request) preconditions {
+	return preconditions{
+		ifMatch:     req.Header.Get("If-Match"),
+		ifNoneMatch: req.Header.Get("If-None-Match"),
+	}
+}
+
+// check returns an error if the preconditions fail for the file
+// in `fpath`. It must be called with the file locked.
+func (p preconditions) check(fpath string) error {
+	if p.ifMatch == "" && p.ifNoneMatch == "" {
+		return nil
+	}
+	etag, err := pathETag(fpath)
+	if err != nil {
+		// notest
+		return err
+	}
+	if checkIfMatch(p.ifMatch, etag) == condFalse ||
+		checkIfNoneMatch(p.ifNoneMatch, etag) == condFalse {
+		return errors.New(PRECONDITION_FAILED_MSG)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sumETag(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return quoteETag(hex.EncodeToString(sum[:]))
+}
+
+func TestPathETag(t *testing.T) {
+	rdir := "/tmp/tupitest-etag"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	fpath := filepath.Join(rdir, "file.txt")
+	os.WriteFile(fpath, []byte("oi"), 0644)
+
+	etag, err := pathETag(fpath)
+	if err != nil || etag != sumETag("oi") {
+		t.Fatalf("bad etag %s %v", etag, err)
+	}
+
+	// the cached etag is used while the file does not change
+	info, _ := os.Stat(fpath)
+	etagCache.Lock()
+	etagCache.m[fpath] = etagEntry{info: info, etag: `"cached"`}
+	etagCache.Unlock()
+	etag, _ = pathETag(fpath)
+	if etag != `"cached"` {
+		t.Fatalf("cache not used %s", etag)
+	}
+
+	// a new file in the same path invalidates the cache
+	os.WriteFile(fpath+".new", []byte("ok"), 0644)
+	os.Rename(fpath+".new", fpath)
+	etag, _ = pathETag(fpath)
+	if etag != sumETag("ok") {
+		t.Fatalf("cache not invalidated %s", etag)
+	}
+
+	// as a change in the modification time
+	etagCache.Lock()
+	etagCache.m[fpath] = etagEntry{info: info, etag: `"cached"`}
+	etagCache.Unlock()
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(fpath, later, later)
+	etag, _ = pathETag(fpath)
+	if etag != sumETag("ok") {
+		t.Fatalf("cache not invalidated by mtime %s", etag)
+	}
+
+	etag, err = pathETag(filepath.Join(rdir, "missing.txt"))
+	if err != nil || etag != "" {
+		t.Fatalf("bad etag for missing file %s %v", etag, err)
+	}
+	etag, err = pathETag(rdir)
+	if err != nil || etag != "" {
+		t.Fatalf("bad etag for dir %s %v", etag, err)
+	}
+}
+
+func TestCheckETagHeaders(t *testing.T) {
+	var tests = []struct {
+		header      string
+		etag        string
+		ifMatch     condResult
+		ifNoneMatch condResult
+	}{
+		{"", `"a"`, condNone, condNone},
+		{`"a"`, `"a"`, condTrue, condFalse},
+		{`"b", "a"`, `"a"`, condTrue, condFalse},
+		{`"b"`, `"a"`, condFalse, condTrue},
+		{`W/"a"`, `"a"`, condFalse, condFalse},
+		{`"a"`, `W/"a"`, condFalse, condFalse},
+		{"*", `"a"`, condTrue, condFalse},
+		{"*", "", condFalse, condTrue},
+		{`"a"`, "", condFalse, condTrue},
+		{"bad", `"a"`, condFalse, condTrue},
+	}
+	for _, test := range tests {
+		if r := checkIfMatch(test.header, test.etag); r != test.ifMatch {
+			t.Errorf("If-Match %s %s: got %d expected %d",
+				test.header, test.etag, r, test.ifMatch)
+		}
+		if r := checkIfNoneMatch(test.header, test.etag); r != test.ifNoneMatch {
+			t.Errorf("If-None-Match %s %s: got %d expected %d",
+				test.header, test.etag, r, test.ifNoneMatch)
+		}
+	}
+}
+
+func TestShowFile_ETag(t *testing.T) {
+	rdir := "/tmp/tupitest-etag"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	css := strings.Repeat("body {color: red;}\n", 100)
+	os.WriteFile(filepath.Join(rdir, "file.txt"), []byte("oi"), 0644)
+	os.WriteFile(filepath.Join(rdir, "app.js"), []byte("var a = 1;"), 0644)
+	os.WriteFile(filepath.Join(rdir, "app.js.gz"), gzipBytes("var a = 1;"), 0644)
+	os.WriteFile(filepath.Join(rdir, "style.css"), []byte(css), 0644)
+	sidecar := sumETag(string(gzipBytes("var a = 1;")))
+
+	var tests = []struct {
+		path    string
+		headers map[string]string
+		status  int
+		etag    string
+	}{
+		{"/file.txt", map[string]string{}, 200, sumETag("oi")},
+		{"/file.txt", map[string]string{"If-None-Match": sumETag("oi")}, 304, sumETag("oi")},
+		{"/file.txt", map[string]string{"If-None-Match": `"other"`}, 200, sumETag("oi")},
+		{"/file.txt", map[string]string{"If-Match": sumETag("oi")}, 200, sumETag("oi")},
+		{"/file.txt", map[string]string{"If-Match": `"other"`}, 412, sumETag("oi")},
+		{"/app.js", map[string]string{"Accept-Encoding": "gzip"}, 200, sidecar},
+		{"/app.js", map[string]string{
+			"Accept-Encoding": "gzip", "If-None-Match": sidecar}, 304, sidecar},
+		{"/style.css", map[string]string{"Accept-Encoding": "gzip"}, 200, "W/" + sumETag(css)},
+		{"/style.css", map[string]string{
+			"Accept-Encoding": "gzip", "If-None-Match": "W/" + sumETag(css)},
+			304, "W/" + sumETag(css)},
+		{"/style.css", map[string]string{
+			"Accept-Encoding": "gzip", "If-Match": sumETag(css)},
+			412, "W/" + sumETag(css)},
+		{"/", map[string]string{}, 200, ""},
+	}
+	minSize := int64(1024)
+	dconf := DomainConfig{
+		Port:            8000,
+		RootDir:         rdir,
+		DefaultToIndex:  new(bool),
+		Compress:        true,
+		CompressMinSize: &minSize,
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s %v",
+				w.Code, test.status, test.path, test.headers)
+		}
+		if etag := w.Header().Get("ETag"); etag != test.etag {
+			t.Errorf("bad etag %s for %s %v", etag, test.path, test.headers)
+		}
+	}
+}
+
+func TestRecievePut_Preconditions(t *testing.T) {
+	rdir := "/tmp/tupitest-etag"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 10,
+		AllowPut:      true,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	var tests = []struct {
+		headers map[string]string
+		body    string
+		status  int
+		content string
+	}{
+		{map[string]string{"If-Match": "*"}, "oi", 412, ""},
+		{map[string]string{"If-None-Match": "*"}, "oi", 201, "oi"},
+		{map[string]string{"If-None-Match": "*"}, "again", 412, "oi"},
+		{map[string]string{"If-Match": sumETag("other")}, "again", 412, "oi"},
+		{map[string]string{"If-Match": sumETag("oi")}, "again", 204, "again"},
+		{map[string]string{"If-None-Match": sumETag("again")}, "oi", 412, "again"},
+		{map[string]string{}, "oi", 204, "oi"},
+	}
+	fpath := filepath.Join(rdir, "file.txt")
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", "/file.txt", strings.NewReader(test.body))
+		req.SetBasicAuth("test", "123")
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %v", w.Code, test.status, test.headers)
+		}
+		if w.Code < 300 && w.Header().Get("ETag") != sumETag(test.body) {
+			t.Errorf("bad etag %s", w.Header().Get("ETag"))
+		}
+		content, _ := os.ReadFile(fpath)
+		if string(content) != test.content {
+			t.Errorf("bad content %s for %v", content, test.headers)
+		}
+	}
+}
+
+func TestRecieveFile_Preconditions(t *testing.T) {
+	rdir := "/tmp/tupitest-etag"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 1000,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+	os.WriteFile(filepath.Join(rdir, "file.txt"), []byte("oi"), 0644)
+
+	var tests = []struct {
+		headers map[string]string
+		status  int
+		etag    string
+	}{
+		{map[string]string{"If-None-Match": "*"}, 412, ""},
+		{map[string]string{"If-Match": sumETag("other")}, 412, ""},
+		{map[string]string{"If-Match": sumETag("oi")}, 201, sumETag("test")},
+	}
+	for _, test := range tests {
+		pr, boundary, _ := createBufferMultipartReader("file.txt", "test", "")
+		req, _ := http.NewRequest("POST", "/u/", pr)
+		req.SetBasicAuth("test", "123")
+		req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+		req.Header.Set("Accept", JSON_CONTENT_TYPE)
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %v", w.Code, test.status, test.headers)
+		}
+		if w.Code == 412 && !strings.Contains(w.Body.String(), ErrCodePreconditionFailed) {
+			t.Errorf("bad body %s", w.Body.String())
+		}
+		if etag := w.Header().Get("ETag"); etag != test.etag {
+			t.Errorf("bad etag %s for %v", etag, test.headers)
+		}
+	}
+}
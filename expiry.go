@@ -0,0 +1,228 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const INVALID_EXPIRES_MSG = "Invalid expires"
+
+// Directory inside the internal dir where the metadata of the files
+// is kept. The metadata of a file has the same path of the file,
+// plus a `,meta` suffix.
+const metaDirName = "meta"
+const metaSuffix = ",meta"
+
+// How often the expired files are removed.
+var janitorInterval = time.Minute
+
+// fileMeta is the metadata tupi keeps about a stored file.
+type fileMeta struct {
+	Expires time.Time `json:"expires"`
+}
+
+// expiry sets when the stored files expire.
+type expiry struct {
+	root string
+	// zero means the files never expire.
+	at time.Time
+}
+
+// newExpiry returns the expiry of the files uploaded to a domain using
+// the default ttl of the domain.
+func newExpiry(c *DomainConfig) *expiry {
+	e := &expiry{root: c.RootDir}
+	if c.DefaultTTL > 0 {
+		e.at = time.Now().Add(time.Duration(c.DefaultTTL) * time.Second)
+	}
+	return e
+}
+
+// parseExpires parses the expiration informed by the client. It may be
+// a number of seconds, a duration like `90m` or a RFC 3339 time.
+func parseExpires(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	var t time.Time
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		t = now.Add(time.Duration(secs) * time.Second)
+	} else if d, err := time.ParseDuration(v); err == nil {
+		t = now.Add(d)
+	} else if t, err = time.Parse(time.RFC3339, v); err != nil {
+		return time.Time{}, errors.New(INVALID_EXPIRES_MSG)
+	}
+	if !t.After(now) {
+		return time.Time{}, errors.New(INVALID_EXPIRES_MSG)
+	}
+	return t, nil
+}
+
+// setFrom changes the expiration to the one informed by the client,
+// if any.
+func (e *expiry) setFrom(v string) error {
+	t, err := parseExpires(v, time.Now())
+	if err != nil || t.IsZero() {
+		return err
+	}
+	e.at = t
+	return nil
+}
+
+// set stores the expiration of a file that was just stored. Files that
+// don't expire have their metadata removed.
+func (e *expiry) set(fpath string) error {
+	if e == nil {
+		return nil
+	}
+	mpath, err := metaPath(e.root, fpath)
+	if err != nil {
+		return err
+	}
+	if e.at.IsZero() {
+		err := os.Remove(mpath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(fileMeta{Expires: e.at})
+	if err != nil {
+		// notest
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(mpath), 0755)
+	if err != nil {
+		// notest
+		return err
+	}
+	return os.WriteFile(mpath, b, 0644)
+}
+
+// extend sets the expiration of a file stored again with the same
+// content. The file lives as long as the longest expiration.
+func (e *expiry) extend(fpath string) error {
+	if e == nil {
+		return nil
+	}
+	m, err := readMeta(e.root, fpath)
+	if err != nil || m.Expires.IsZero() {
+		return nil
+	}
+	if !e.at.IsZero() && e.at.Before(m.Expires) {
+		return nil
+	}
+	return e.set(fpath)
+}
+
+// metaPath returns the path of the metadata of a file inside the root dir.
+func metaPath(root string, fpath string) (string, error) {
+	return internalFilePath(root, metaDirName, fpath, metaSuffix)
+}
+
+func readMeta(root string, fpath string) (*fileMeta, error) {
+	mpath, err := metaPath(root, fpath)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(mpath)
+	if err != nil {
+		return nil, err
+	}
+	m := &fileMeta{}
+	err = json.Unmarshal(b, m)
+	return m, err
+}
+
+// isExpired informs if a file inside the root dir is expired.
+func isExpired(root string, fpath string) bool {
+	m, err := readMeta(root, fpath)
+	if err != nil {
+		return false
+	}
+	return !m.Expires.IsZero() && time.Now().After(m.Expires)
+}
+
+// removeExpired removes the expired files inside the root dir.
+// The metadata of files that don't exist anymore is removed too.
+func removeExpired(root string) {
+	mdir := filepath.Join(root, internalDirName, metaDirName)
+	filepath.WalkDir(mdir, func(mpath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(mpath, metaSuffix) {
+			return nil
+		}
+		rel, _ := filepath.Rel(mdir, strings.TrimSuffix(mpath, metaSuffix))
+		fpath := filepath.Join(root, rel)
+
+		AcquireLock(fpath)
+		defer ReleaseLock(fpath)
+
+		_, err = os.Lstat(fpath)
+		if errors.Is(err, fs.ErrNotExist) {
+			os.Remove(mpath)
+			return nil
+		}
+		if !isExpired(root, fpath) {
+			return nil
+		}
+		Debugf("removing expired file %s", fpath)
+		err = os.Remove(fpath)
+		if err != nil {
+			// notest
+			Errorf("error removing expired file %s: %s", fpath, err.Error())
+			return nil
+		}
+		os.Remove(mpath)
+		forgetUsage(fpath)
+		return nil
+	})
+}
+
+// runJanitor periodically removes the expired files of all domains.
+func runJanitor(conf Config) {
+	// notest
+	for {
+		for _, root := range rootDirs(conf) {
+			removeExpired(root)
+		}
+		time.Sleep(janitorInterval)
+	}
+}
+
+// rootDirs returns the root dirs of all domains, without duplicates.
+func rootDirs(conf Config) []string {
+	seen := make(map[string]bool)
+	dirs := make([]string, 0)
+	for _, c := range conf.Domains {
+		dir := filepath.Clean(c.RootDir)
+		if c.RootDir == "" || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
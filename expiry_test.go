@@ -0,0 +1,166 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseExpires(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		value    string
+		expected time.Time
+		has_err  bool
+	}{
+		{"", time.Time{}, false},
+		{"60", now.Add(time.Minute), false},
+		{"2h", now.Add(2 * time.Hour), false},
+		{"2026-01-02T00:00:00Z", now.Add(24 * time.Hour), false},
+		{"2025-01-02T00:00:00Z", time.Time{}, true},
+		{"-60", time.Time{}, true},
+		{"tomorrow", time.Time{}, true},
+	}
+	for _, test := range tests {
+		exp, err := parseExpires(test.value, now)
+		if (err != nil) != test.has_err {
+			t.Errorf("bad error for %s: %v", test.value, err)
+		}
+		if !exp.Equal(test.expected) {
+			t.Errorf("bad expires for %s: %s", test.value, exp)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	dir := "/tmp/tupitest"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "a", "file.txt")
+	os.MkdirAll(filepath.Dir(fpath), 0755)
+	os.WriteFile(fpath, []byte("oi"), 0644)
+
+	var e *expiry
+	if e.set(fpath) != nil || e.extend(fpath) != nil {
+		t.Errorf("nil expiry with error")
+	}
+
+	later := time.Now().Add(time.Hour)
+	e = &expiry{root: dir, at: later}
+	e.set(fpath)
+	if isExpired(dir, fpath) {
+		t.Errorf("file expired too soon")
+	}
+	// extend never shortens the life of a file
+	(&expiry{root: dir, at: time.Now().Add(time.Minute)}).extend(fpath)
+	m, _ := readMeta(dir, fpath)
+	if !m.Expires.Equal(later) {
+		t.Errorf("expiration shortened %s", m.Expires)
+	}
+
+	e.at = time.Now().Add(-time.Second)
+	e.set(fpath)
+	if !isExpired(dir, fpath) {
+		t.Errorf("file not expired")
+	}
+	removeExpired(dir)
+	if fileExists(fpath) {
+		t.Errorf("expired file not removed")
+	}
+	mpath, _ := metaPath(dir, fpath)
+	if fileExists(mpath) {
+		t.Errorf("metadata not removed")
+	}
+}
+
+func TestRecieveFile_Expires(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 1000,
+		DefaultTTL:    3600,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+	handler := server.Servers[0].Server.Handler
+
+	var tests = []struct {
+		fname   string
+		expires string
+		status  int
+		ttl     time.Duration
+	}{
+		{"a.txt", "", 201, time.Hour},
+		{"b.txt", "10m", 201, 10 * time.Minute},
+		{"c.txt", "bad", 400, 0},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		bw := multipart.NewWriter(buf)
+		file, _ := bw.CreateFormFile("file", test.fname)
+		file.Write([]byte("oi"))
+		if test.expires != "" {
+			field, _ := bw.CreateFormField("expires")
+			field.Write([]byte(test.expires))
+		}
+		bw.Close()
+		req, _ := http.NewRequest("POST", "/u/", buf)
+		req.SetBasicAuth("test", "123")
+		req.Header.Set("Content-Type", bw.FormDataContentType())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("got %d, expected %d for %s", w.Code, test.status, test.fname)
+		}
+		if test.ttl == 0 {
+			continue
+		}
+		m, err := readMeta(rdir, filepath.Join(rdir, test.fname))
+		if err != nil {
+			t.Fatalf("no metadata for %s", test.fname)
+		}
+		if d := time.Until(m.Expires); d > test.ttl || d < test.ttl-time.Minute {
+			t.Errorf("bad expiration for %s: %s", test.fname, m.Expires)
+		}
+	}
+
+	e := &expiry{root: rdir, at: time.Now().Add(-time.Second)}
+	e.set(filepath.Join(rdir, "a.txt"))
+	req, _ := http.NewRequest("GET", "/a.txt", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusGone {
+		t.Errorf("got %d for expired file", w.Code)
+	}
+}
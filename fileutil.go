@@ -19,9 +19,9 @@ package tupi
 
 import (
 	"archive/tar"
-	"bytes"
-	"compress/gzip"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -30,29 +30,111 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const INVALID_PREFIX_MSG = "Invalid prefix"
+const NO_FILE_MSG = "No file in request"
+
+// pattern for the temporary files used while receiving uploads.
+// They are created in the same directory of the final file so
+// they can be atomically renamed into place.
+const tmpFilePattern = ".tupi-upload-*"
+
+// Directory inside the root dir where tupi keeps its own data.
+// It is never served nor listed.
+const internalDirName = ".tupi"
 
 var chunkSize int64 = 10 << 20
 
 type uploadedFile struct {
-	content []byte
+	tmpPath string
 	fname   string
-	prefix  string
+	size    int64
+	// hex encoded sha256 of the contents of the file
+	sha256 string
+	// sha256 informed by the client.
+	expectedSha256 string
+	// the first bytes of the file, used to sniff its content type
+	head []byte
+}
+
+// upload holds all the files sent in a multipart upload request
+type upload struct {
+	files  []*uploadedFile
+	prefix string
+	// when the files expire, as informed by the client.
+	expires string
+	// for archives, removes the files not in the archives.
+	mirror bool
+	// for archives, only reports what would change.
+	dryRun bool
+}
+
+// uploadOptions are the options used to store the uploaded files
+type uploadOptions struct {
+	// how the stored files are named. Empty keeps the original name.
+	naming string
+	// what to do when the file already exists. Empty overwrites it.
+	collision string
+	// sha256 informed in the request headers. Only valid for
+	// requests with a single file.
+	digest string
+	// which file types can be uploaded. nil means any type.
+	filter *typeFilter
+	// disk quota for the stored files. nil means no quota.
+	quota *quota
+	// keeps the overwritten files. nil means they are lost.
+	versions *versioner
+	// when the stored files expire. nil means no metadata is kept.
+	expiry *expiry
+	// limits for the extracted archives. Zero values are no limit.
+	limits extractLimits
+	// what is kept from the headers of the extracted archives.
+	preserve extractPreserve
+	// conditional headers checked against the overwritten files.
+	preconditions preconditions
+}
+
+func newUploadOptions(c *DomainConfig) uploadOptions {
+	return uploadOptions{
+		naming:    valueOf(c.FileNaming),
+		collision: collisionPolicy(c),
+		filter:    newTypeFilter(c),
+		versions:  newVersioner(c),
+		expiry:    newExpiry(c),
+		limits:    newExtractLimits(c),
+		preserve:  newExtractPreserve(c),
+	}
+}
+
+// uploadResult is the result of storing one of the files of an upload.
+type uploadResult struct {
+	fname string
+	// path of the file relative to the upload dir
+	path        string
+	size        int64
+	sha256      string
+	overwritten bool
+	err         error
 }
 
-func getFileFromRequest(r *multipart.Reader) (*uploadedFile, error) {
-	var fname string
-	var prefix string
-	var fcontent []byte
+// getFileFromRequest reads the parts of a multipart upload. The contents
+// of each file are streamed into a temporary file inside `dir` so the memory
+// used does not depend on the size of the uploaded files. The caller is
+// responsible for renaming or removing the temporary files. The files
+// are not written beyond the quota of `opts`, if any.
+func getFileFromRequest(r *multipart.Reader, dir string, opts uploadOptions) (*upload, error) {
+	u := &upload{}
+	sums := make([]string, 0)
+	var received int64
+	hasPrefix := false
 	for {
 		part, err := r.NextPart()
 
@@ -61,6 +143,7 @@ func getFileFromRequest(r *multipart.Reader) (*uploadedFile, error) {
 		}
 
 		if err != nil {
+			u.discard()
 			return nil, err
 		}
 
@@ -68,73 +151,464 @@ func getFileFromRequest(r *multipart.Reader) (*uploadedFile, error) {
 
 		switch formname {
 		case "file":
-			fname = part.FileName()
-			fcontent, err = ioutil.ReadAll(part)
+			// the file may replace one with the same name
+			credit := opts.overwriteCredit(dir, u.prefix, hasPrefix, part.FileName())
+			pending := received - credit
+			f, err := writeTempFile(dir, opts.quota.limitReader(part, pending))
 			if err != nil {
+				u.discard()
 				return nil, err
 			}
+			received += f.size
+			f.fname = part.FileName()
+			u.files = append(u.files, f)
 
 		case "prefix":
 			bytes_prefix, err := ioutil.ReadAll(part)
 			if err != nil {
+				u.discard()
 				return nil, err
 			}
-			prefix = string(bytes_prefix)
+			u.prefix = string(bytes_prefix)
+			hasPrefix = true
+
+		case "sha256":
+			bytes_sum, err := ioutil.ReadAll(part)
+			if err != nil {
+				u.discard()
+				return nil, err
+			}
+			sums = append(sums, string(bytes_sum))
+
+		case "expires":
+			bytes_expires, err := ioutil.ReadAll(part)
+			if err != nil {
+				u.discard()
+				return nil, err
+			}
+			u.expires = string(bytes_expires)
+
+		case "mirror", "dryrun":
+			bytes_flag, err := ioutil.ReadAll(part)
+			if err != nil {
+				u.discard()
+				return nil, err
+			}
+			flag, _ := strconv.ParseBool(string(bytes_flag))
+			if formname == "mirror" {
+				u.mirror = flag
+			} else {
+				u.dryRun = flag
+			}
 		}
 
 	}
+	err := u.setExpectedSums(sums, opts.digest)
+	if err != nil {
+		u.discard()
+		return nil, err
+	}
+	return u, nil
+}
+
+// overwriteCredit returns the bytes released from the quota when the
+// file `fname` of an upload replaces an existing one. The prefix may be
+// sent after the file, so until it is received any file in the quota
+// may be the one replaced.
+func (o uploadOptions) overwriteCredit(dir string, prefix string, hasPrefix bool, fname string) int64 {
+	// files stored with other names don't replace the existing ones.
+	if o.collision == collisionError || o.collision == collisionSuffix ||
+		(o.naming != "" && o.naming != namingOriginal) {
+		return 0
+	}
+	if !hasPrefix {
+		return o.quota.maxCredit()
+	}
+	prefix = strings.TrimLeft(prefix, string(os.PathSeparator))
+	if !isValidPrefix(prefix) {
+		return 0
+	}
+	return o.quota.credit(filepath.Join(dir, prefix, fname))
+}
 
+// setExpectedSums sets the sha256 informed by the client for each file.
+// The sha256 fields are in the same order of the files. The digest
+// from the request headers can only be used with a single file.
+func (u *upload) setExpectedSums(sums []string, digest string) error {
+	if len(sums) > 0 && len(sums) != len(u.files) {
+		return errors.New(INVALID_DIGEST_MSG)
+	}
+	if digest != "" && len(u.files) > 1 {
+		return errors.New(INVALID_DIGEST_MSG)
+	}
+	for i, sum := range sums {
+		sum, err := parseHexDigest(sum)
+		if err != nil {
+			return err
+		}
+		u.files[i].expectedSha256 = sum
+	}
+	if digest != "" && len(u.files) == 1 {
+		f := u.files[0]
+		if f.expectedSha256 != "" && f.expectedSha256 != digest {
+			return errors.New(CHECKSUM_MISMATCH_MSG)
+		}
+		f.expectedSha256 = digest
+	}
+	return nil
+}
+
+// discard removes the temporary files of an upload
+func (u *upload) discard() {
+	for _, f := range u.files {
+		f.discard()
+	}
+}
+
+// discard removes the temporary file of an uploaded file
+func (f *uploadedFile) discard() {
+	if f.tmpPath != "" {
+		os.Remove(f.tmpPath)
+		f.tmpPath = ""
+	}
+}
+
+// verify checks the sha256 of the file against the one informed
+// by the client, if any.
+func (f *uploadedFile) verify() error {
+	if f.expectedSha256 != "" && f.expectedSha256 != f.sha256 {
+		return errors.New(CHECKSUM_MISMATCH_MSG)
+	}
+	return nil
+}
+
+// writeTempFile streams the contents of `r` into a new temporary file
+// inside `dir`. The sha256 of the contents is computed while writing.
+func writeTempFile(dir string, r io.Reader) (*uploadedFile, error) {
+	tmp, err := os.CreateTemp(dir, tmpFilePattern)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	hw := &headWriter{}
+	n, err := io.Copy(io.MultiWriter(tmp, h, hw), r)
+	if err == nil {
+		// CreateTemp uses 0600 but we want the same
+		// permissions we would have with os.Create
+		err = tmp.Chmod(0644)
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
 	f := &uploadedFile{
-		content: fcontent,
-		prefix:  prefix,
-		fname:   fname,
+		tmpPath: tmp.Name(),
+		size:    n,
+		sha256:  hex.EncodeToString(h.Sum(nil)),
+		head:    hw.head,
 	}
 	return f, nil
 }
 
-// writeFile writes the contents of an uploaded file into a file in the
-// local fs.
-func writeFile(dir string, r *multipart.Reader, randfname bool, prevent_overwrite bool) (string, error) {
-
-	f, err := getFileFromRequest(r)
+// copyTempFile copies `src` into a new temporary file inside `dir`. It
+// is used when `dir` is in another file system, where `src` can't be
+// renamed or linked to.
+func copyTempFile(src string, dir string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		// notest
+		return "", err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(dir, tmpFilePattern)
+	if err != nil {
+		// notest
+		return "", err
+	}
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
 	if err != nil {
+		// notest
+		os.Remove(tmp.Name())
 		return "", err
 	}
-	fname := f.fname
-	if randfname {
-		fname, err = genRandFname(fname)
+	return tmp.Name(), nil
+}
+
+// renameFile renames `src` to `dst`. When they are in different file
+// systems, like a prefix dir that is a mount point, `src` is copied
+// next to `dst` and renamed from there.
+func renameFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	tmp, err := copyTempFile(src, filepath.Dir(dst))
+	if err != nil {
+		// notest
+		return err
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		// notest
+		os.Remove(tmp)
+		return err
+	}
+	os.Remove(src)
+	return nil
+}
+
+// readTempFile returns the uploaded file for a file already written
+// in `tmpPath`, like the data of a resumable upload. The sha256 and the
+// head of the content are read from the file as writeTempFile does
+// while writing it.
+func readTempFile(tmpPath string) (*uploadedFile, error) {
+	fd, err := os.Open(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	hw := &headWriter{}
+	n, err := io.Copy(io.MultiWriter(h, hw), fd)
+	if err != nil {
+		// notest
+		return nil, err
+	}
+	f := &uploadedFile{
+		tmpPath: tmpPath,
+		size:    n,
+		sha256:  hex.EncodeToString(h.Sum(nil)),
+		head:    hw.head,
+	}
+	return f, nil
+}
+
+// replaceWithSymlink atomically replaces `fpath` by a symlink to
+// `target`. The link is created with a temporary name and renamed
+// over `fpath`.
+func replaceWithSymlink(target string, fpath string) error {
+	rnd, err := genRandFname("symlink")
+	if err != nil {
+		// notest
+		return err
+	}
+	tmpPath := filepath.Join(
+		filepath.Dir(fpath), strings.TrimSuffix(tmpFilePattern, "*")+rnd)
+	err = os.Symlink(target, tmpPath)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, fpath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// linkTempFile creates a hard link to `src` with a temporary name
+// inside `dir`.
+func linkTempFile(dir string, src string) (*uploadedFile, error) {
+	rnd, err := genRandFname("link")
+	if err != nil {
+		// notest
+		return nil, err
+	}
+	tmpPath := filepath.Join(dir, strings.TrimSuffix(tmpFilePattern, "*")+rnd)
+	err = os.Link(src, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		// notest
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	f := &uploadedFile{tmpPath: tmpPath, size: info.Size()}
+	_, err = f.contentSha256()
+	if err != nil {
+		// notest
+		f.discard()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeFile writes the contents of the uploaded files into files in the
+// local fs. Each file succeeds or fails on its own and the result for
+// each one is returned. The returned error is for errors that affect
+// the whole upload.
+func writeFile(dir string, r *multipart.Reader, opts uploadOptions) ([]uploadResult, error) {
+
+	u, err := getFileFromRequest(r, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer u.discard()
+
+	if len(u.files) == 0 {
+		return nil, errors.New(NO_FILE_MSG)
+	}
+	prefix := strings.TrimLeft(u.prefix, string(os.PathSeparator))
+	if !isValidPrefix(prefix) {
+		return nil, errors.New(INVALID_PREFIX_MSG)
+	}
+	if opts.expiry != nil {
+		err = opts.expiry.setFrom(u.expires)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
-	prefix := strings.TrimLeft(f.prefix, string(os.PathSeparator))
-	if containsDotDot(prefix) {
-		return "", errors.New(INVALID_PREFIX_MSG)
-	}
-	var fpath string
-	sep := string(os.PathSeparator)
-	if prefix != "" {
-		base_dir := dir + sep + prefix + sep
-		os.MkdirAll(base_dir, 0755)
-		fpath = dir + sep + prefix + sep + fname
-	} else {
-		fpath = dir + sep + fname
+
+	results := make([]uploadResult, 0, len(u.files))
+	for _, f := range u.files {
+		results = append(results, storeFile(dir, prefix, f, opts))
 	}
+	return results, nil
+}
 
-	if fileExists(fpath) && prevent_overwrite {
-		return "", errors.New("File " + fname + " already exists")
+// storeFile moves an uploaded file from its temporary path to its
+// final place inside `dir`. `prefix` must be already validated.
+func storeFile(dir string, prefix string, f *uploadedFile, opts uploadOptions) uploadResult {
+	r := uploadResult{fname: f.fname, size: f.size, sha256: f.sha256}
+	if f.fname == "" {
+		r.err = errors.New(NO_FILE_MSG)
+		return r
+	}
+	r.err = f.verify()
+	if r.err != nil {
+		return r
+	}
+	r.err = opts.filter.check(f.fname, f.head)
+	if r.err != nil {
+		return r
+	}
+	fname, err := storedName(f, opts.naming, time.Now())
+	if err != nil {
+		// notest
+		r.err = err
+		return r
+	}
+	if fname == "" || !isValidPrefix(fname) {
+		r.err = errors.New(INVALID_FNAME_MSG)
+		return r
 	}
+	fpath := filepath.Join(dir, prefix, fname)
+	os.MkdirAll(filepath.Dir(fpath), 0755)
+
 	AcquireLock(fpath)
 	defer ReleaseLock(fpath)
 
-	newf, err := os.Create(fpath)
+	r.err = opts.preconditions.check(fpath)
+	if r.err != nil {
+		return r
+	}
+	exists := fileExists(fpath)
+	if exists && isDir(fpath) {
+		r.err = errors.New("File " + fname + " is a directory")
+		return r
+	}
+	switch {
+	case exists && opts.naming == namingHash:
+		// same name, same content. Nothing to store.
+		f.discard()
+		r.err = opts.expiry.extend(fpath)
+		if r.err != nil {
+			// notest
+			return r
+		}
+		f.tmpPath = ""
+		r.fname = filepath.ToSlash(fname)
+		r.path = path.Join(filepath.ToSlash(prefix), r.fname)
+		return r
+
+	case exists && opts.collision == collisionError:
+		r.err = errors.New("File " + fname + " already exists")
+		return r
+
+	case exists && opts.collision == collisionSuffix:
+		// stored with a new name
+		r.err = opts.quota.reserve("", f.size)
+		if r.err != nil {
+			return r
+		}
+		fpath, r.err = storeWithSuffix(f.tmpPath, fpath)
+		if r.err != nil {
+			// notest
+			opts.quota.forget()
+			return r
+		}
+		fname = filepath.Join(filepath.Dir(fname), filepath.Base(fpath))
+		exists = false
+
+	default:
+		r.err = opts.quota.reserve(fpath, f.size)
+		if r.err != nil {
+			return r
+		}
+		if exists {
+			r.err = opts.versions.save(fpath)
+			if r.err != nil {
+				// notest
+				opts.quota.forget()
+				return r
+			}
+		}
+		r.err = renameFile(f.tmpPath, fpath)
+		if r.err != nil {
+			opts.quota.forget()
+			return r
+		}
+	}
+	f.tmpPath = ""
+	r.err = opts.expiry.set(fpath)
+	if r.err != nil {
+		// notest
+		return r
+	}
+
+	r.fname = filepath.ToSlash(fname)
+	r.path = path.Join(filepath.ToSlash(prefix), r.fname)
+	r.overwritten = exists
+	return r
+}
+
+func isDir(fpath string) bool {
+	st, err := os.Stat(fpath)
+	return err == nil && st.IsDir()
+}
+
+func isEmptyDir(fpath string) bool {
+	f, err := os.Open(fpath)
 	if err != nil {
-		return "", err
+		// notest
+		return false
 	}
-	io.Copy(newf, bytes.NewBuffer(f.content))
-	defer newf.Close()
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	return err == io.EOF
+}
 
-	return fname, nil
+// isWithinDir informs if `fpath` is `dir` or is inside `dir`. Both
+// paths must be clean.
+func isWithinDir(dir string, fpath string) bool {
+	rel, err := filepath.Rel(dir, fpath)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
 }
 
 func fileExists(fpath string) bool {
@@ -145,29 +619,68 @@ func fileExists(fpath string) bool {
 	return !errors.Is(err, os.ErrNotExist)
 }
 
-// extractFiles extract the contents of a tar.gz file to the local
-// file system. All files will be extracted inside `root_dir`
-func extractFiles(file io.Reader, root_dir string, prevent_overwrite bool) ([]string, error) {
-	buf, err := gzip.NewReader(file)
+// extractFiles extract the contents of an archive to the local
+// file system. All files will be extracted inside `root_dir` and the
+// archive is refused if it goes beyond the extract limits in `opts`.
+// When an entry is refused the files and directories created by the
+// archive are removed. The files replaced are not restored.
+func extractFiles(file io.ReaderAt, size int64, root_dir string, opts uploadOptions) (_ []uploadResult, err error) {
+	ar, err := openArchive(file, size)
 	if err != nil {
 		return nil, err
 	}
-	defer buf.Close()
-	tr := tar.NewReader(buf)
-	files := make([]string, 0)
+	defer ar.close()
+	root_dir = filepath.Clean(root_dir)
+	err = os.MkdirAll(root_dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	realRoot, err := filepath.EvalSymlinks(root_dir)
+	if err != nil {
+		// notest
+		return nil, err
+	}
+	counter := &extractCounter{limits: opts.limits, size: size}
+	files := make([]uploadResult, 0)
+	created := make([]string, 0)
+	defer func() {
+		if err != nil {
+			removeCreated(created)
+			opts.quota.forget()
+		}
+	}()
+	// the metadata of the directories is applied after their
+	// contents are extracted.
+	dirs := make([]string, 0)
+	dirEntries := make([]*archiveEntry, 0)
 	for {
-		hdr, err := tr.Next()
+		hdr, err := ar.next()
 		if err == io.EOF {
 			break
 		}
 
+		if err != nil {
+			return nil, err
+		}
+		err = counter.entry()
 		if err != nil {
 			return nil, err
 		}
 
-		fname := hdr.Name
-		path := filepath.Join(root_dir, fname)
-		switch hdr.Typeflag {
+		fname := hdr.name
+		path, err := extractPath(root_dir, realRoot, fname)
+		if err != nil {
+			return nil, err
+		}
+		if path == root_dir {
+			// entries like `./` are the root dir itself.
+			if hdr.typeflag != tar.TypeDir {
+				return nil, errors.New(INVALID_ENTRY_MSG + " " + fname)
+			}
+			continue
+		}
+		created = append(created, missingPaths(root_dir, path)...)
+		switch hdr.typeflag {
 		case tar.TypeDir:
 			// for a directory we hold the lock till the end of the function
 			// to avoid someome messing with a directory we are working inside
@@ -177,51 +690,297 @@ func extractFiles(file io.Reader, root_dir string, prevent_overwrite bool) ([]st
 			if err != nil {
 				return nil, err
 			}
-			files = append(files, fname)
+			dirs = append(dirs, path)
+			dirEntries = append(dirEntries, hdr)
+			files = append(files, uploadResult{fname: fname, path: fname})
 
 		case tar.TypeReg:
-			if fileExists(path) && prevent_overwrite {
-				return nil, errors.New("File " + path + " already exists")
+			r, err := extractRegular(path, hdr, hdr.size, counter.reader(hdr.r), opts)
+			if err != nil {
+				return nil, err
 			}
-			AcquireLock(path)
-			out, err := os.Create(path)
+			files = append(files, r)
+
+		case tar.TypeLink:
+			// the linked file must be a regular file already extracted.
+			// Unless the links are preserved a copy of it is extracted.
+			src, err := extractPath(root_dir, realRoot, hdr.linkname)
 			if err != nil {
-				ReleaseLock(path)
 				return nil, err
 			}
-			_, err = io.Copy(out, tr)
-			ReleaseLock(path)
+			info, err := os.Lstat(src)
+			if err != nil || !info.Mode().IsRegular() {
+				return nil, errors.New(INVALID_ENTRY_MSG + " " + fname)
+			}
+			var r uploadResult
+			if opts.preserve.links {
+				r, err = extractLink(path, hdr, src, opts)
+			} else {
+				var srcFile *os.File
+				srcFile, err = os.Open(src)
+				if err != nil {
+					// notest
+					return nil, err
+				}
+				r, err = extractRegular(
+					path, hdr, info.Size(), counter.reader(srcFile), opts)
+				srcFile.Close()
+			}
 			if err != nil {
 				return nil, err
 			}
-			files = append(files, fname)
+			files = append(files, r)
 
 		case tar.TypeSymlink:
-			target := filepath.Join(filepath.Dir(path), hdr.Linkname)
-			// if the symlink points to a file outside of the root_dir
-			// we append the root_dir to it, basically breaking the link
-			if !strings.HasPrefix(target, root_dir) {
-				target = filepath.Join(root_dir, strings.TrimLeft(target, "/"))
+			// the content type of served files is based in the file
+			// extension so the name of the links must be checked too.
+			err := opts.filter.checkName(fname)
+			if err != nil {
+				return nil, err
+			}
+			target := symlinkTarget(root_dir, path, hdr.linkname)
+			if isInternalTarget(root_dir, realRoot, target) {
+				return nil, errors.New(INVALID_ENTRY_MSG + " " + fname)
 			}
 
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				return nil, err
+			}
 			AcquireLock(path)
-			err := os.Symlink(target, path)
+			_, err = os.Lstat(path)
+			exists := err == nil
+			if exists && opts.collision == collisionError {
+				err = errors.New("File " + path + " already exists")
+			} else {
+				err = replaceWithSymlink(target, path)
+			}
 			ReleaseLock(path)
 			if err != nil {
 				return nil, err
 			}
 
-			files = append(files, fname)
+			files = append(files, uploadResult{
+				fname: fname, path: fname, overwritten: exists})
+
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return nil, errors.New(UNSUPPORTED_ENTRY_MSG + " " + fname)
 
 		default:
 			// notest
-			log.Printf("Unknown type %d for %s", hdr.Typeflag, path)
+			log.Printf("Unknown type %d for %s", hdr.typeflag, path)
 		}
 
 	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := opts.preserve.apply(dirs[i], dirEntries[i])
+		if err != nil {
+			// notest
+			return nil, err
+		}
+	}
 	return files, nil
 }
 
+// symlinkTarget returns the target of a symlink entry extracted to
+// `path`. If the symlink points to a file outside of the root_dir
+// we append the root_dir to it, basically breaking the link.
+func symlinkTarget(root_dir string, path string, linkname string) string {
+	target := filepath.Join(filepath.Dir(path), linkname)
+	if !isWithinDir(root_dir, target) {
+		target = filepath.Join(root_dir, strings.TrimLeft(target, "/"))
+	}
+	return target
+}
+
+// isInternalTarget informs if the symlink `target` points to the
+// internal files, by its name or through the links that already exist.
+// Those links would serve the internal files. `realRoot` is `root_dir`
+// with its links resolved, empty if it does not exist yet.
+func isInternalTarget(root_dir string, realRoot string, target string) bool {
+	rel, err := filepath.Rel(root_dir, target)
+	if err != nil || isInternalPath(rel) {
+		return true
+	}
+	if realRoot == "" {
+		return false
+	}
+	real, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return false
+	}
+	rel, err = filepath.Rel(realRoot, real)
+	return err != nil || isInternalPath(rel)
+}
+
+// missingPaths returns `fpath` and its parent dirs inside `root_dir`
+// that don't exist yet, the parents first.
+func missingPaths(root_dir string, fpath string) []string {
+	missing := make([]string, 0)
+	for p := fpath; p != root_dir && isWithinDir(root_dir, p); p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		}
+		missing = append([]string{p}, missing...)
+	}
+	return missing
+}
+
+// removeCreated removes the paths created by an extraction that
+// failed, the last created first. Directories are removed only if they
+// are empty so files stored by other requests are kept.
+func removeCreated(created []string) {
+	for i := len(created) - 1; i >= 0; i-- {
+		AcquireLock(created[i])
+		os.Remove(created[i])
+		ReleaseLock(created[i])
+	}
+}
+
+// entryPath returns the path where an entry of an archive is extracted,
+// checking only the name of the entry.
+func entryPath(root_dir string, name string) (string, error) {
+	err := errors.New(INVALID_ENTRY_MSG + " " + name)
+	if name == "" || filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") ||
+		isInternalPath(name) {
+		return "", err
+	}
+	fpath := filepath.Join(root_dir, name)
+	if !isWithinDir(root_dir, fpath) {
+		return "", err
+	}
+	return fpath, nil
+}
+
+// extractPath returns the path where an entry of an archive is
+// extracted. Absolute names, internal files and entries that would be
+// extracted outside `root_dir`, even through links extracted before,
+// are refused. `realRoot` is `root_dir` with its links resolved.
+func extractPath(root_dir string, realRoot string, name string) (string, error) {
+	fpath, err := entryPath(root_dir, name)
+	if err != nil || fpath == root_dir {
+		return fpath, err
+	}
+	ok, err := parentWithinDir(root_dir, realRoot, fpath)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New(INVALID_ENTRY_MSG + " " + name)
+	}
+	return fpath, nil
+}
+
+// parentWithinDir informs if the nearest parent dir of `fpath` that
+// exists is inside `realRoot` with its links resolved. The parent dirs
+// may be links so checking only the path of `fpath` inside `root_dir`
+// is not enough.
+func parentWithinDir(root_dir string, realRoot string, fpath string) (bool, error) {
+	parent := filepath.Dir(fpath)
+	for {
+		real, err := filepath.EvalSymlinks(parent)
+		if err == nil {
+			return isWithinDir(realRoot, real), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) || parent == root_dir {
+			return false, err
+		}
+		parent = filepath.Dir(parent)
+	}
+}
+
+// extractRegular stores a regular file extracted from an archive.
+func extractRegular(path string, hdr *archiveEntry, size int64, r io.Reader, opts uploadOptions) (uploadResult, error) {
+	res := uploadResult{fname: hdr.name, path: hdr.name}
+	if fileExists(path) && opts.collision == collisionError {
+		return res, errors.New("File " + path + " already exists")
+	}
+	err := opts.quota.reserve(path, size)
+	if err != nil {
+		return res, err
+	}
+	res, err = extractReserved(path, hdr, r, opts)
+	if err != nil {
+		opts.quota.forget()
+	}
+	return res, err
+}
+
+// extractReserved stores a regular file that already has room
+// in the quota.
+func extractReserved(path string, hdr *archiveEntry, r io.Reader, opts uploadOptions) (uploadResult, error) {
+	res := uploadResult{fname: hdr.name, path: hdr.name}
+	// not all archives have entries for the directories
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return res, err
+	}
+	f, err := writeTempFile(filepath.Dir(path), r)
+	if err != nil {
+		return res, err
+	}
+	err = opts.filter.check(hdr.name, f.head)
+	if err != nil {
+		f.discard()
+		return res, err
+	}
+	return placeExtracted(path, hdr, f, opts)
+}
+
+// extractLink stores a hard link to `src`, a file extracted before.
+// The link uses no disk space so it does not count for the quota.
+func extractLink(path string, hdr *archiveEntry, src string, opts uploadOptions) (uploadResult, error) {
+	res := uploadResult{fname: hdr.name, path: hdr.name}
+	if fileExists(path) && opts.collision == collisionError {
+		return res, errors.New("File " + path + " already exists")
+	}
+	err := opts.filter.checkName(hdr.name)
+	if err != nil {
+		return res, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return res, err
+	}
+	f, err := linkTempFile(filepath.Dir(path), src)
+	if err != nil {
+		return res, err
+	}
+	return placeExtracted(path, hdr, f, opts)
+}
+
+// placeExtracted moves an extracted file from its temporary path to
+// its final place, with the metadata of the archive entry.
+func placeExtracted(path string, hdr *archiveEntry, f *uploadedFile, opts uploadOptions) (uploadResult, error) {
+	res := uploadResult{fname: hdr.name, path: hdr.name}
+	err := opts.preserve.apply(f.tmpPath, hdr)
+	if err != nil {
+		f.discard()
+		return res, err
+	}
+	AcquireLock(path)
+	exists := fileExists(path)
+	if exists {
+		err = opts.versions.save(path)
+	}
+	if err == nil {
+		err = os.Rename(f.tmpPath, path)
+	}
+	if err == nil {
+		err = opts.expiry.set(path)
+	}
+	ReleaseLock(path)
+	if err != nil {
+		f.discard()
+		return res, err
+	}
+	res.size = f.size
+	res.sha256 = f.sha256
+	res.overwritten = exists
+	return res, nil
+}
+
 func genRandFname(fname string) (string, error) {
 	b := make([]byte, 8)
 	_, err := rand.Read(b)
@@ -231,9 +990,32 @@ func genRandFname(fname string) (string, error) {
 	return fmt.Sprintf("%x-", b) + fname, nil
 }
 
+// serveOptions are the options to serve files and directories.
+type serveOptions struct {
+	compress compressOptions
+	list     listOptions
+}
+
+func newServeOptions(c *DomainConfig) serveOptions {
+	return serveOptions{
+		compress: newCompressOptions(c),
+		list:     listOptions{template: c.DirListTemplate, maxLimit: c.DirListLimit},
+	}
+}
+
+// httpFilePath returns the path in the local fs of the file `name`
+// of `fsys`. Only the files of a http.Dir have a path.
+func httpFilePath(fsys http.FileSystem, name string) string {
+	dir, ok := fsys.(http.Dir)
+	if !ok {
+		return ""
+	}
+	return filepath.Join(string(dir), filepath.FromSlash(path.Clean("/"+name)))
+}
+
 // from now on it a copy with modifications from the http package code
 // name is '/'-separated, not filepath.Separator.
-func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string) {
+func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string, opts serveOptions) {
 	f, err := fs.Open(name)
 	if err != nil {
 		msg, code := toHTTPError(err)
@@ -266,10 +1048,18 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name
 			return
 		}
 		setLastModified(w, d.ModTime())
-		dirList(w, r, f)
+		dirList(w, r, f, d, httpFilePath(fs, name), opts.list)
 		return
 	}
 
+	// http.ServeContent checks the conditional requests
+	// against the etag header.
+	if etag := httpFileETag(fs, name, f, d); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if serveCompressed(w, r, fs, name, d, f, opts.compress) {
+		return
+	}
 	http.ServeContent(w, r, d.Name(), d.ModTime(), f)
 }
 
@@ -317,6 +1107,28 @@ func checkIfModifiedSince(r *http.Request, modtime time.Time) condResult {
 	return condTrue
 }
 
+// checkPreconditions evaluates the conditional headers of a GET request
+// for a file with `etag` and `modtime`. Returns true if the response
+// was already written.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, etag string, modtime time.Time) bool {
+	if checkIfMatch(r.Header.Get("If-Match"), etag) == condFalse {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return true
+	}
+	switch checkIfNoneMatch(r.Header.Get("If-None-Match"), etag) {
+	case condFalse:
+		writeNotModified(w)
+		return true
+
+	case condNone:
+		if checkIfModifiedSince(r, modtime) == condFalse {
+			writeNotModified(w)
+			return true
+		}
+	}
+	return false
+}
+
 // isZeroTime reports whether t is obviously unspecified (either zero or Unix()=0).
 func isZeroTime(t time.Time) bool {
 	return t.IsZero() || t.Equal(time.Unix(0, 0))
@@ -346,62 +1158,53 @@ var htmlReplacer = strings.NewReplacer(
 	"'", "&#39;",
 )
 
-type anyDirs interface {
-	len() int
-	name(i int) string
-	isDir(i int) bool
+// internalFilePath returns the path of a file kept by tupi about a file
+// inside the root dir. It is in the `kind` dir inside the internal dir
+// with the same path of the file inside the root dir plus `suffix`.
+func internalFilePath(root string, kind string, fpath string, suffix string) (string, error) {
+	rel, err := filepath.Rel(root, fpath)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", errors.New("File " + fpath + " is not inside the root dir")
+	}
+	return filepath.Join(root, internalDirName, kind, rel) + suffix, nil
 }
 
-type fileInfoDirs []fs.FileInfo
-
-func (d fileInfoDirs) len() int          { return len(d) }       // notest
-func (d fileInfoDirs) isDir(i int) bool  { return d[i].IsDir() } // notest
-func (d fileInfoDirs) name(i int) string { return d[i].Name() }  // notest
-
-type dirEntryDirs []fs.DirEntry
-
-func (d dirEntryDirs) len() int          { return len(d) }
-func (d dirEntryDirs) isDir(i int) bool  { return d[i].IsDir() }
-func (d dirEntryDirs) name(i int) string { return d[i].Name() }
-
-func dirList(w http.ResponseWriter, r *http.Request, f http.File) {
-	// Prefer to use ReadDir instead of Readdir,
-	// because the former doesn't require calling
-	// Stat on every entry of a directory on Unix.
-	var dirs anyDirs
-	var err error
-	if d, ok := f.(fs.ReadDirFile); ok {
-		var list dirEntryDirs
-		list, err = d.ReadDir(-1)
-		dirs = list
-	} else {
-		// notest
-		var list fileInfoDirs
-		list, err = f.Readdir(-1)
-		dirs = list
+// removeInternalFiles removes what is kept by tupi about a removed file
+// or directory, like its expiration and its previous versions, so they
+// don't outlive the file.
+func removeInternalFiles(root string, fpath string, isDir bool) {
+	kinds := map[string]string{metaDirName: metaSuffix, versionsDirName: versionsDirSuffix}
+	for kind, suffix := range kinds {
+		ipath, err := internalFilePath(root, kind, fpath, suffix)
+		if err != nil {
+			// notest
+			continue
+		}
+		os.RemoveAll(ipath)
+		if isDir {
+			// the files inside the directory
+			os.RemoveAll(strings.TrimSuffix(ipath, suffix))
+		}
 	}
+}
 
-	if err != nil {
-		Errorf("http: error reading directory: %v", err)
-		http.Error(w, "Error reading directory", http.StatusInternalServerError)
-		return
-	}
-	sort.Slice(dirs, func(i, j int) bool { return dirs.name(i) < dirs.name(j) })
+// isValidPrefix informs if a prefix sent by a client can be used
+// to store files.
+func isValidPrefix(prefix string) bool {
+	return !containsDotDot(prefix) && !isInternalPath(prefix)
+}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, "<pre>\n")
-	for i, n := 0, dirs.len(); i < n; i++ {
-		name := dirs.name(i)
-		if dirs.isDir(i) {
-			name += "/"
+// isInternalPath informs if a path is part of the internal tupi
+// files, like the internal dir or temporary upload files.
+func isInternalPath(v string) bool {
+	tmpPrefix := strings.TrimSuffix(tmpFilePattern, "*")
+	for _, ent := range strings.FieldsFunc(v, isSlashRune) {
+		if ent == internalDirName || strings.HasPrefix(ent, tmpPrefix) {
+			return true
 		}
-		// name may contain '?' or '#', which must be escaped to remain
-		// part of the URL path, and not indicate the start of a query
-		// string or fragment.
-		url := url.URL{Path: name}
-		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", url.String(), htmlReplacer.Replace(name))
 	}
-	fmt.Fprintf(w, "</pre>\n")
+	return false
 }
 
 func isSlashRune(r rune) bool { return r == '/' || r == '\\' }
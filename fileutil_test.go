@@ -19,8 +19,12 @@ package tupi
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"mime/multipart"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -30,14 +34,14 @@ func TestWriteFile(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	var tests = []struct {
-		content           []byte
-		randfname         bool
-		prevent_overwrite bool
-		has_err           bool
+		content   []byte
+		naming    string
+		collision string
+		has_err   bool
 	}{
-		{[]byte("oi"), false, false, false},
-		{[]byte("oi"), true, false, false},
-		{[]byte("oi"), false, true, true},
+		{[]byte("oi"), namingOriginal, collisionOverwrite, false},
+		{[]byte("oi"), namingRandom, collisionOverwrite, false},
+		{[]byte("oi"), namingOriginal, collisionError, true},
 	}
 
 	for _, test := range tests {
@@ -47,12 +51,17 @@ func TestWriteFile(t *testing.T) {
 
 		}
 
-		fname, err := writeFile(dir, r, test.randfname, test.prevent_overwrite)
+		opts := uploadOptions{naming: test.naming, collision: test.collision}
+		results, err := writeFile(dir, r, opts)
+		if err != nil {
+			t.Fatalf("Error writing file: %s", err)
+		}
+		fname, err := results[0].fname, results[0].err
 		if err != nil && !test.has_err {
 			t.Errorf("Error writing file: %s", err)
 		}
 
-		if fname != "file.txt" && !test.randfname && !test.has_err {
+		if fname != "file.txt" && test.naming == namingOriginal && !test.has_err {
 			t.Errorf("File %s not present", fname)
 		}
 
@@ -64,7 +73,7 @@ func TestExtractFiles(t *testing.T) {
 	f, _ := os.ReadFile("./testdata/test.tar.gz")
 	root_dir := "/tmp/xx"
 	defer os.RemoveAll(root_dir)
-	fl, err := extractFiles(bytes.NewBuffer(f), root_dir, false)
+	fl, err := extractFiles(bytes.NewReader(f), int64(len(f)), root_dir, uploadOptions{})
 
 	if err != nil {
 		t.Errorf("error extracting files %s", err)
@@ -73,7 +82,8 @@ func TestExtractFiles(t *testing.T) {
 	bad_links := make(map[string]bool, 0)
 	bad_links["bla/ble/bad.txt"] = true
 
-	for _, fname := range fl {
+	for _, r := range fl {
+		fname := r.fname
 		path := filepath.Join(root_dir, fname)
 		_, err = os.Stat(path)
 		is_bad := bad_links[fname]
@@ -82,9 +92,206 @@ func TestExtractFiles(t *testing.T) {
 		}
 	}
 
-	_, err = extractFiles(bytes.NewBuffer(f), root_dir, true)
+	_, err = extractFiles(bytes.NewReader(f), int64(len(f)), root_dir, uploadOptions{collision: collisionError})
 
 	if err == nil {
 		t.Errorf("Error preventing overwrite")
 	}
 }
+
+func TestExtractFiles_Formats(t *testing.T) {
+	root_dir := "/tmp/tupitest-formats"
+	defer os.RemoveAll(root_dir)
+
+	var tests = []struct {
+		path    string
+		has_err bool
+	}{
+		{"./testdata/test.tar.gz", false},
+		{"./testdata/test.tar.bz2", false},
+		{"./testdata/test.tar", false},
+		{"./testdata/test.zip", false},
+		{"./testdata/file.txt", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			os.RemoveAll(root_dir)
+			f, _ := os.ReadFile(test.path)
+			fl, err := extractFiles(
+				bytes.NewReader(f), int64(len(f)), root_dir, uploadOptions{})
+
+			if (err != nil) != test.has_err {
+				t.Fatalf("bad error for %s: %v", test.path, err)
+			}
+			if test.has_err {
+				if err.Error() != UNSUPPORTED_ARCHIVE_MSG {
+					t.Fatalf("bad error %s", err)
+				}
+				return
+			}
+			if len(fl) != 7 {
+				t.Fatalf("bad files count %d", len(fl))
+			}
+			c, err := os.ReadFile(filepath.Join(root_dir, "bla/ble/four.txt"))
+			if err != nil {
+				t.Fatalf("error reading link %s", err)
+			}
+			if string(c) != "333\n" {
+				t.Fatalf("bad link content %q", c)
+			}
+			_, err = os.Stat(filepath.Join(root_dir, "bla/ble/bad.txt"))
+			if err == nil {
+				t.Fatalf("link outside root should be broken")
+			}
+		})
+	}
+}
+
+func TestWriteFile_NoTempFilesLeft(t *testing.T) {
+	dir := "/tmp/tupitest"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		prefix  string
+		has_err bool
+	}{
+		{"some-prefix", false},
+		// the file already exists
+		{"some-prefix", true},
+		{"../bad-prefix", true},
+	}
+
+	for _, test := range tests {
+		buf, boundary, err := createBufferMultipartReader("file.txt", "oi", test.prefix)
+		if err != nil {
+			t.Fatalf("Error creating reader %s", err)
+		}
+		r := multipart.NewReader(buf, boundary)
+		results, err := writeFile(dir, r, uploadOptions{collision: collisionError})
+		if err == nil {
+			err = results[0].err
+		}
+		if (err != nil) != test.has_err {
+			t.Errorf("Bad error for prefix %s: %v", test.prefix, err)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "some-prefix", "file.txt"))
+	if err != nil || string(b) != "oi" {
+		t.Errorf("Bad file content %s %v", b, err)
+	}
+
+	tmps, _ := filepath.Glob(filepath.Join(dir, tmpFilePattern))
+	if len(tmps) > 0 {
+		t.Errorf("Temporary files left behind %v", tmps)
+	}
+}
+
+func TestWriteFile_MultipleFiles(t *testing.T) {
+	dir := "/tmp/tupitest"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("old"), 0644)
+
+	buf, boundary, err := createMultiFileBufferReader(
+		[]string{"a.txt", "b.txt", "c.txt"}, []string{"a", "b", "c"}, "")
+	if err != nil {
+		t.Fatalf("Error creating reader %s", err)
+	}
+	r := multipart.NewReader(buf, boundary)
+	results, err := writeFile(dir, r, uploadOptions{collision: collisionError})
+	if err != nil {
+		t.Fatalf("Error writing files %s", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Bad results len %d", len(results))
+	}
+	// b.txt already exists so it must fail but the others are stored
+	if results[0].err != nil || results[2].err != nil {
+		t.Errorf("Error writing files %v", results)
+	}
+	if results[1].err == nil {
+		t.Errorf("Overwrite not prevented for b.txt")
+	}
+	for _, fname := range []string{"a.txt", "c.txt"} {
+		if !fileExists(filepath.Join(dir, fname)) {
+			t.Errorf("File %s not present", fname)
+		}
+	}
+}
+
+func TestIsInternalPath(t *testing.T) {
+	var tests = []struct {
+		path     string
+		internal bool
+	}{
+		{"/file.txt", false},
+		{"/.tupi/tus/123", true},
+		{"some/.tupi", true},
+		{"/.tupirc", false},
+		{"/dir/.tupi-upload-123", true},
+	}
+	for _, test := range tests {
+		if isInternalPath(test.path) != test.internal {
+			t.Errorf("Bad isInternalPath for %s", test.path)
+		}
+	}
+}
+
+func TestWriteFile_Checksum(t *testing.T) {
+	dir := "/tmp/tupitest"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+
+	// a valid sha256 that is not the sha256 of "oi"
+	sum := "1a4c8e0d2f5e3e8e6d8a0c5b6e0c1ce5e0d6d7a6d6d1b1e7ef1b2b2d87b7c6b6"
+	good := fmt.Sprintf("%x", sha256.Sum256([]byte("oi")))
+	var tests = []struct {
+		field   string
+		digest  string
+		has_err bool
+	}{
+		{"", "", false},
+		{good, "", false},
+		{strings.ToUpper(good), good, false},
+		{sum, "", true},
+		{"", sum, true},
+		{good, sum, true},
+		{"not-hex", "", true},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		bw := multipart.NewWriter(buf)
+		file, _ := bw.CreateFormFile("file", "file.txt")
+		file.Write([]byte("oi"))
+		if test.field != "" {
+			field, _ := bw.CreateFormField("sha256")
+			field.Write([]byte(test.field))
+		}
+		bw.Close()
+		r := multipart.NewReader(buf, bw.Boundary())
+		os.Remove(filepath.Join(dir, "file.txt"))
+
+		results, err := writeFile(dir, r, uploadOptions{digest: test.digest})
+		if err == nil {
+			err = results[0].err
+		}
+		if (err != nil) != test.has_err {
+			t.Errorf("Bad error for %s %s: %v", test.field, test.digest, err)
+		}
+		if err == nil && results[0].sha256 != good {
+			t.Errorf("Bad sha256 %s", results[0].sha256)
+		}
+		if test.has_err && fileExists(filepath.Join(dir, "file.txt")) {
+			t.Errorf("File stored with bad checksum")
+		}
+	}
+	tmps, _ := filepath.Glob(filepath.Join(dir, tmpFilePattern))
+	if len(tmps) > 0 {
+		t.Errorf("Temporary files left behind %v", tmps)
+	}
+}
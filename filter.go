@@ -0,0 +1,159 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const UNSUPPORTED_TYPE_MSG = "File type not allowed"
+
+// how many bytes are used to sniff the content type of a file.
+// The same used by http.DetectContentType
+const sniffLen = 512
+
+// typeFilter decides which files can be uploaded based in the
+// file extension and in the sniffed content type. Deny rules have
+// precedence over allow rules and if there are allow rules the file
+// must match one of them.
+type typeFilter struct {
+	allowExts  []string
+	denyExts   []string
+	allowTypes []string
+	denyTypes  []string
+}
+
+// newTypeFilter returns a filter for the domain config or nil if
+// the domain does not restrict the uploaded files.
+func newTypeFilter(c *DomainConfig) *typeFilter {
+	if len(c.UploadAllowExtensions) == 0 && len(c.UploadDenyExtensions) == 0 &&
+		len(c.UploadAllowTypes) == 0 && len(c.UploadDenyTypes) == 0 {
+		return nil
+	}
+	return &typeFilter{
+		allowExts:  normalizeExts(c.UploadAllowExtensions),
+		denyExts:   normalizeExts(c.UploadDenyExtensions),
+		allowTypes: normalizeTypes(c.UploadAllowTypes),
+		denyTypes:  normalizeTypes(c.UploadDenyTypes),
+	}
+}
+
+// checkName checks if a file name is allowed.
+func (tf *typeFilter) checkName(fname string) error {
+	if tf == nil {
+		return nil
+	}
+	fname = strings.ToLower(fname)
+	if matchesExt(fname, tf.denyExts) {
+		return errors.New(UNSUPPORTED_TYPE_MSG + ": " + fname)
+	}
+	if len(tf.allowExts) > 0 && !matchesExt(fname, tf.allowExts) {
+		return errors.New(UNSUPPORTED_TYPE_MSG + ": " + fname)
+	}
+	return nil
+}
+
+// check checks if a file is allowed by its name and by the content type
+// sniffed from the first bytes of the file.
+func (tf *typeFilter) check(fname string, head []byte) error {
+	if tf == nil {
+		return nil
+	}
+	if err := tf.checkName(fname); err != nil {
+		return err
+	}
+	if len(tf.allowTypes) == 0 && len(tf.denyTypes) == 0 {
+		return nil
+	}
+	ctype, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if matchesType(ctype, tf.denyTypes) {
+		return errors.New(UNSUPPORTED_TYPE_MSG + ": " + fname)
+	}
+	if len(tf.allowTypes) > 0 && !matchesType(ctype, tf.allowTypes) {
+		return errors.New(UNSUPPORTED_TYPE_MSG + ": " + fname)
+	}
+	return nil
+}
+
+func matchesExt(fname string, exts []string) bool {
+	for _, ext := range exts {
+		if strings.HasSuffix(fname, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesType checks a content type against a list of types. The
+// types may use wildcards like `image/*`
+func matchesType(ctype string, types []string) bool {
+	for _, t := range types {
+		if t == ctype {
+			return true
+		}
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(ctype, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeExts(exts []string) []string {
+	norm := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		norm = append(norm, ext)
+	}
+	return norm
+}
+
+func normalizeTypes(types []string) []string {
+	norm := make([]string, 0, len(types))
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" {
+			norm = append(norm, t)
+		}
+	}
+	return norm
+}
+
+// headWriter keeps the first bytes written to it so we can sniff
+// the content type of a file while it is written.
+type headWriter struct {
+	head []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if missing := sniffLen - len(w.head); missing > 0 {
+		if len(p) < missing {
+			missing = len(p)
+		}
+		w.head = append(w.head, p[:missing]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTypeFilter(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A")
+	html := []byte("<html><body>oi</body></html>")
+	var tests = []struct {
+		conf    DomainConfig
+		fname   string
+		head    []byte
+		allowed bool
+	}{
+		{DomainConfig{}, "a.html", html, true},
+		{DomainConfig{UploadDenyExtensions: []string{"html", ".JS"}}, "a.HTML", html, false},
+		{DomainConfig{UploadDenyExtensions: []string{"html", ".JS"}}, "a.js", html, false},
+		{DomainConfig{UploadDenyExtensions: []string{"html"}}, "a.png", png, true},
+		{DomainConfig{UploadAllowExtensions: []string{"png", "tar.gz"}}, "a.png", png, true},
+		{DomainConfig{UploadAllowExtensions: []string{"png", "tar.gz"}}, "a.tar.gz", png, true},
+		{DomainConfig{UploadAllowExtensions: []string{"png"}}, "a.txt", png, false},
+		{DomainConfig{UploadDenyTypes: []string{"text/html"}}, "a.png", html, false},
+		{DomainConfig{UploadAllowTypes: []string{"image/*"}}, "a.png", png, true},
+		{DomainConfig{UploadAllowTypes: []string{"image/*"}}, "a.png", html, false},
+		{DomainConfig{UploadAllowTypes: []string{"image/*"},
+			UploadDenyTypes: []string{"image/png"}}, "a.png", png, false},
+	}
+	for _, test := range tests {
+		tf := newTypeFilter(&test.conf)
+		err := tf.check(test.fname, test.head)
+		if (err == nil) != test.allowed {
+			t.Errorf("Bad check for %s %+v: %v", test.fname, test.conf, err)
+		}
+	}
+}
+
+func TestExtractFiles_TypeFilter(t *testing.T) {
+	f, _ := os.ReadFile("./testdata/test.tar.gz")
+	root_dir := "/tmp/xx"
+	defer os.RemoveAll(root_dir)
+
+	conf := DomainConfig{UploadDenyExtensions: []string{".txt"}}
+	opts := newUploadOptions(&conf)
+	_, err := extractFiles(bytes.NewReader(f), int64(len(f)), root_dir, opts)
+	if err == nil {
+		t.Fatalf("Denied file extracted")
+	}
+	status, code := uploadErrorCode(err)
+	if status != 415 || code != ErrCodeUnsupportedType {
+		t.Errorf("Bad error for denied file %d %s", status, code)
+	}
+	if fileExists(filepath.Join(root_dir, "bla", "one.txt")) {
+		t.Errorf("Denied file extracted")
+	}
+}
@@ -0,0 +1,598 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// types of the entries in a listing
+const (
+	entryTypeFile  = "file"
+	entryTypeDir   = "dir"
+	entryTypeOther = "other"
+)
+
+// listEntry is an entry of a directory listing. Symlinks have the type,
+// size and modification time of their targets.
+type listEntry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mtime   time.Time `json:"mtime"`
+	Symlink bool      `json:"symlink"`
+	// url of the entry relative to the listed directory
+	URL string `json:"-"`
+}
+
+// dirListing is the json response of a listing and the data for
+// the listing templates.
+type dirListing struct {
+	Path    string      `json:"path"`
+	Entries []listEntry `json:"entries"`
+	// url of the next page. Empty in the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// listOptions are the options of a domain for the directory listings.
+type listOptions struct {
+	// template file for the html listings. Empty uses the
+	// default listing.
+	template string
+	// max number of entries in a page. No limit if 0.
+	maxLimit int
+}
+
+// listQuery are the options of a listing sent in the query string.
+type listQuery struct {
+	// html or json
+	format string
+	// name, size or mtime
+	sort string
+	desc bool
+	// file or dir. Empty lists all the entries.
+	ftype string
+	// pattern for the names of the listed entries
+	glob string
+	// max number of entries in the page. No limit if 0.
+	limit int
+	// name of the last entry of the previous page
+	after string
+	// size or mtime, in unix nanoseconds, of the last entry of the
+	// previous page when sorted by size or mtime.
+	afterKey string
+}
+
+// parseListQuery returns the listing options of a request. Without the
+// format param json is used if the client accepts it. The limit is
+// never bigger than `maxLimit`, if any.
+func parseListQuery(r *http.Request, maxLimit int) (listQuery, error) {
+	v := r.URL.Query()
+	q := listQuery{
+		format:   v.Get("format"),
+		sort:     v.Get("sort"),
+		ftype:    v.Get("type"),
+		glob:     v.Get("glob"),
+		after:    v.Get("after"),
+		afterKey: v.Get("after_key"),
+	}
+	if q.format == "" {
+		q.format = "html"
+		if wantsJSON(r) {
+			q.format = "json"
+		}
+	}
+	if q.format != "html" && q.format != "json" {
+		return q, errors.New("Invalid format " + q.format)
+	}
+	if q.sort == "" {
+		q.sort = "name"
+	}
+	if q.sort != "name" && q.sort != "size" && q.sort != "mtime" {
+		return q, errors.New("Invalid sort " + q.sort)
+	}
+	switch v.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.desc = true
+	default:
+		return q, errors.New("Invalid order " + v.Get("order"))
+	}
+	if q.ftype != "" && q.ftype != entryTypeFile && q.ftype != entryTypeDir {
+		return q, errors.New("Invalid type " + q.ftype)
+	}
+	if _, err := path.Match(q.glob, ""); err != nil {
+		return q, errors.New("Invalid glob " + q.glob)
+	}
+	if l := v.Get("limit"); l != "" {
+		var err error
+		q.limit, err = strconv.Atoi(l)
+		if err != nil || q.limit <= 0 {
+			return q, errors.New("Invalid limit " + l)
+		}
+	}
+	if maxLimit > 0 && (q.limit == 0 || q.limit > maxLimit) {
+		q.limit = maxLimit
+	}
+	return q, nil
+}
+
+// matches informs if an entry is listed with the filters of the query.
+func (q listQuery) matches(e listEntry) bool {
+	if q.ftype != "" && e.Type != q.ftype {
+		return false
+	}
+	if q.glob == "" {
+		return true
+	}
+	ok, _ := path.Match(q.glob, e.Name)
+	return ok
+}
+
+// cursor returns the last entry of the previous page. When sorted by
+// size or mtime the key of the entry is in the query, so the page is
+// found even if the entry was removed. Without the key the entry must
+// be in the directory.
+func (q listQuery) cursor(v *sortedView) (listEntry, error) {
+	c := listEntry{Name: q.after}
+	invalid := errors.New("Invalid cursor " + q.after)
+	if v.key == "name" {
+		return c, nil
+	}
+	if q.afterKey == "" {
+		for _, e := range v.entries {
+			if e.Name == q.after {
+				return e, nil
+			}
+		}
+		return c, invalid
+	}
+	k, err := strconv.ParseInt(q.afterKey, 10, 64)
+	if err != nil {
+		return c, invalid
+	}
+	if v.key == "size" {
+		c.Size = k
+	} else {
+		c.Mtime = time.Unix(0, k)
+	}
+	return c, nil
+}
+
+// cursorKey returns the key of the entry `e` for the cursor of a
+// listing sorted by `key`. Empty when sorted by name.
+func cursorKey(key string, e listEntry) string {
+	switch key {
+	case "size":
+		return strconv.FormatInt(e.Size, 10)
+	case "mtime":
+		return strconv.FormatInt(e.Mtime.UnixNano(), 10)
+	}
+	return ""
+}
+
+// page returns the entries of the page of the listing and the last
+// entry of the page if there is a next page.
+func (q listQuery) page(d *cachedDir) ([]listEntry, *listEntry, error) {
+	view := d.sorted(q.sort)
+	n := len(view.entries)
+	at := func(i int) listEntry {
+		if q.desc {
+			return view.entries[n-1-i]
+		}
+		return view.entries[i]
+	}
+
+	start := 0
+	if q.after != "" {
+		c, err := q.cursor(view)
+		if err != nil {
+			return nil, nil, err
+		}
+		start = view.after(c, q.desc)
+	}
+	entries := make([]listEntry, 0)
+	for i := start; i < n; i++ {
+		e := at(i)
+		if !q.matches(e) {
+			continue
+		}
+		if q.limit > 0 && len(entries) == q.limit {
+			return entries, &entries[len(entries)-1], nil
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil, nil
+}
+
+// entryLess informs if the entry `a` comes before `b` when sorted by
+// `key`. Ties are sorted by name.
+func entryLess(key string, a, b listEntry) bool {
+	switch {
+	case key == "size" && a.Size != b.Size:
+		return a.Size < b.Size
+
+	case key == "mtime" && !a.Mtime.Equal(b.Mtime):
+		return a.Mtime.Before(b.Mtime)
+	}
+	return a.Name < b.Name
+}
+
+// sortedView are the entries of a directory sorted by a key.
+type sortedView struct {
+	key     string
+	entries []listEntry
+}
+
+// after returns the index, in the listing order, of the first entry after
+// the entry `c`. `c` doesn't need to be in the directory.
+func (v *sortedView) after(c listEntry, desc bool) int {
+	n := len(v.entries)
+	if desc {
+		return n - sort.Search(n, func(i int) bool { return !entryLess(v.key, v.entries[i], c) })
+	}
+	return sort.Search(n, func(i int) bool { return entryLess(v.key, c, v.entries[i]) })
+}
+
+// cachedDir are the entries of a listed directory. The entries are
+// read once and the views sorted by size and mtime are created when
+// needed, so the pages of a big directory don't need to read it
+// again. It is valid while the directory is not changed.
+type cachedDir struct {
+	// path of the directory in the local fs. Empty if not cached.
+	path  string
+	info  fs.FileInfo
+	mu    sync.Mutex
+	views map[string]*sortedView
+	// entries accounted in the cache and the element in the lru
+	// list. Changed only with the cache locked.
+	cost int
+	elem *list.Element
+}
+
+func newCachedDir(dirPath string, info fs.FileInfo, entries []listEntry) *cachedDir {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	byName := &sortedView{key: "name", entries: entries}
+	return &cachedDir{path: dirPath, info: info, views: map[string]*sortedView{"name": byName}}
+}
+
+// isValid informs if the cache is valid for the directory with `info`.
+// Adding, removing or renaming entries changes the modification time
+// of a directory, and so do the uploads as the files are renamed into
+// it. Files changed in place by other means keep their old size and
+// modification time until the directory changes.
+func (d *cachedDir) isValid(info fs.FileInfo) bool {
+	return os.SameFile(d.info, info) && d.info.ModTime().Equal(info.ModTime())
+}
+
+// sorted returns the entries sorted by `key`.
+func (d *cachedDir) sorted(key string) *sortedView {
+	d.mu.Lock()
+	v, ok := d.views[key]
+	if !ok {
+		v = d.sort(key)
+		d.views[key] = v
+	}
+	d.mu.Unlock()
+	if !ok && d.path != "" {
+		listCache.grow(d, len(v.entries))
+	}
+	return v
+}
+
+// sort returns a new view of the entries sorted by `key`.
+func (d *cachedDir) sort(key string) *sortedView {
+	entries := make([]listEntry, len(d.views["name"].entries))
+	copy(entries, d.views["name"].entries)
+	sort.SliceStable(entries, func(i, j int) bool { return entryLess(key, entries[i], entries[j]) })
+	return &sortedView{key: key, entries: entries}
+}
+
+// max number of entries kept in the cache. Each sorted view of a
+// directory counts for all its entries. When it is reached the least
+// recently listed directories are removed from the cache. A directory
+// bigger than that is cached alone.
+const maxListCacheEntries = 1000000
+
+// dirCache keeps the listed directories by their path.
+type dirCache struct {
+	sync.Mutex
+	m map[string]*cachedDir
+	// the cached directories, the most recently listed first.
+	lru *list.List
+	// entries in the views of the cached directories
+	entries int
+}
+
+var listCache = newDirCache()
+
+func newDirCache() *dirCache {
+	return &dirCache{m: make(map[string]*cachedDir), lru: list.New()}
+}
+
+func (c *dirCache) get(dirPath string) (*cachedDir, bool) {
+	c.Lock()
+	defer c.Unlock()
+	d, ok := c.m[dirPath]
+	if ok {
+		c.lru.MoveToFront(d.elem)
+	}
+	return d, ok
+}
+
+// add adds a directory with `n` entries to the cache.
+func (c *dirCache) add(d *cachedDir, n int) {
+	c.Lock()
+	defer c.Unlock()
+	if old, ok := c.m[d.path]; ok {
+		c.remove(old)
+	}
+	d.cost = n
+	d.elem = c.lru.PushFront(d)
+	c.m[d.path] = d
+	c.entries += n
+	c.evict()
+}
+
+// grow accounts a new view with `n` entries of a cached directory.
+func (c *dirCache) grow(d *cachedDir, n int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.m[d.path] != d {
+		return
+	}
+	d.cost += n
+	c.entries += n
+	c.evict()
+}
+
+// evict removes the least recently listed directories until the cache
+// fits in maxListCacheEntries. The most recently listed directory is
+// never removed.
+func (c *dirCache) evict() {
+	for c.entries > maxListCacheEntries && c.lru.Len() > 1 {
+		c.remove(c.lru.Back().Value.(*cachedDir))
+	}
+}
+
+func (c *dirCache) remove(d *cachedDir) {
+	c.lru.Remove(d.elem)
+	delete(c.m, d.path)
+	c.entries -= d.cost
+}
+
+// listDir returns the entries of the directory `f`, with `info`, from
+// the cache or reading the directory. `dirPath` is the path of the
+// directory in the local fs, used as the cache key and to follow
+// symlinks. Without it the directory is not cached.
+func listDir(f http.File, info fs.FileInfo, dirPath string) (*cachedDir, error) {
+	if dirPath != "" {
+		d, ok := listCache.get(dirPath)
+		if ok && d.isValid(info) {
+			return d, nil
+		}
+	}
+	entries, err := readDirEntries(f, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	d := newCachedDir(dirPath, info, entries)
+	if dirPath == "" {
+		// notest
+		return d, nil
+	}
+	listCache.add(d, len(entries))
+	return d, nil
+}
+
+// readDirEntries returns the entries of the directory `f`, without the
+// internal files. `dirPath` is the path of the directory in the local fs
+// and it is used to follow the symlinks. If empty the symlinks are
+// not followed.
+func readDirEntries(f http.File, dirPath string) ([]listEntry, error) {
+	// Prefer to use ReadDir instead of Readdir,
+	// because the former doesn't require calling
+	// Stat on every entry of a directory on Unix.
+	var infos []fs.FileInfo
+	if d, ok := f.(fs.ReadDirFile); ok {
+		list, err := d.ReadDir(-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, de := range list {
+			info, err := de.Info()
+			if err != nil {
+				// removed after the directory was read
+				continue
+			}
+			infos = append(infos, info)
+		}
+	} else {
+		// notest
+		list, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		infos = list
+	}
+
+	entries := make([]listEntry, 0, len(infos))
+	for _, info := range infos {
+		if isInternalPath(info.Name()) {
+			continue
+		}
+		entries = append(entries, newListEntry(info, dirPath))
+	}
+	return entries, nil
+}
+
+func newListEntry(info fs.FileInfo, dirPath string) listEntry {
+	e := listEntry{Name: info.Name()}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		e.Symlink = true
+		if dirPath != "" {
+			target, err := os.Stat(filepath.Join(dirPath, info.Name()))
+			if err == nil {
+				info = target
+			}
+		}
+	}
+	switch {
+	case info.IsDir():
+		e.Type = entryTypeDir
+	case info.Mode().IsRegular():
+		e.Type = entryTypeFile
+	default:
+		e.Type = entryTypeOther
+	}
+	if e.Type != entryTypeDir {
+		e.Size = info.Size()
+	}
+	e.Mtime = info.ModTime()
+
+	name := e.Name
+	if e.Type == entryTypeDir {
+		name += "/"
+	}
+	// name may contain '?' or '#', which must be escaped to remain
+	// part of the URL path, and not indicate the start of a query
+	// string or fragment.
+	u := url.URL{Path: name}
+	e.URL = u.String()
+	return e
+}
+
+// nextPageURL returns the url of the page after the entry `after` of a
+// listing sorted by `key`. The other params of the query are kept.
+func nextPageURL(r *http.Request, key string, after listEntry) string {
+	v := r.URL.Query()
+	v.Set("after", after.Name)
+	v.Del("after_key")
+	if k := cursorKey(key, after); k != "" {
+		v.Set("after_key", k)
+	}
+	u := url.URL{Path: r.URL.Path, RawQuery: v.Encode()}
+	return u.String()
+}
+
+// dirList writes the listing of the directory `f` with `info`. The
+// listing is json or html, in which case the template of the options
+// is used, if any. When there is a next page its url is in the
+// `Link` header.
+func dirList(w http.ResponseWriter, r *http.Request, f http.File, info fs.FileInfo,
+	dirPath string, opts listOptions) {
+	// the format of the listing depends on the Accept header.
+	w.Header().Add("Vary", "Accept")
+	q, err := parseListQuery(r, opts.maxLimit)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+	d, err := listDir(f, info, dirPath)
+	if err != nil {
+		Errorf("http: error reading directory: %v", err)
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	entries, after, err := q.page(d)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+	listing := dirListing{Path: r.URL.Path, Entries: entries}
+	if after != nil {
+		listing.Next = nextPageURL(r, q.sort, *after)
+		w.Header().Set("Link", "<"+listing.Next+`>; rel="next"`)
+	}
+
+	if q.format == "json" {
+		writeJSON(w, http.StatusOK, listing)
+		return
+	}
+	if opts.template != "" {
+		writeTemplateListing(w, listing, opts.template)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, e := range listing.Entries {
+		name := e.Name
+		if e.Type == entryTypeDir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", e.URL, htmlReplacer.Replace(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+	if listing.Next != "" {
+		fmt.Fprintf(w, "<a href=\"%s\" rel=\"next\">next</a>\n", htmlReplacer.Replace(listing.Next))
+	}
+}
+
+// the parsed listing templates by file path. A template is parsed
+// once, when the config is validated, and not for each listing.
+var listTemplates = struct {
+	sync.Mutex
+	m map[string]*template.Template
+}{m: make(map[string]*template.Template)}
+
+// listTemplate returns the parsed template in the file `tmpl`.
+func listTemplate(tmpl string) (*template.Template, error) {
+	listTemplates.Lock()
+	defer listTemplates.Unlock()
+	if t, ok := listTemplates.m[tmpl]; ok {
+		return t, nil
+	}
+	t, err := template.ParseFiles(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	listTemplates.m[tmpl] = t
+	return t, nil
+}
+
+// writeTemplateListing writes a listing using the template file `tmpl`.
+// The template is rendered before anything is written so a broken
+// template does not produce a half written page.
+func writeTemplateListing(w http.ResponseWriter, listing dirListing, tmpl string) {
+	t, err := listTemplate(tmpl)
+	var buf bytes.Buffer
+	if err == nil {
+		err = t.Execute(&buf, listing)
+	}
+	if err != nil {
+		Errorf("error rendering listing template: %s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,368 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listingTestServer(rdir string, tmpl string) TupiServer {
+	return setupTestServer(rdir, func(c *DomainConfig) {
+		c.DefaultToIndex = new(bool)
+		c.DirListTemplate = tmpl
+	})
+}
+
+func createListingDir(rdir string) {
+	os.MkdirAll(filepath.Join(rdir, "dir", "sub"), 0755)
+	os.MkdirAll(filepath.Join(rdir, "dir", ".tupi"), 0755)
+	os.WriteFile(filepath.Join(rdir, "dir", "a.txt"), []byte("aaa"), 0644)
+	os.WriteFile(filepath.Join(rdir, "dir", "b.tar.gz"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(rdir, "dir", "c#1.txt"), []byte("cc"), 0644)
+	os.Symlink("sub", filepath.Join(rdir, "dir", "link"))
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(rdir, "dir", "a.txt"), old, old)
+}
+
+func TestParseListQuery(t *testing.T) {
+	var tests = []struct {
+		query    string
+		accept   string
+		maxLimit int
+		format   string
+		limit    int
+		err      bool
+	}{
+		{"", "", 0, "html", 0, false},
+		{"", JSON_CONTENT_TYPE, 0, "json", 0, false},
+		{"format=json", "", 0, "json", 0, false},
+		{"format=html", JSON_CONTENT_TYPE, 0, "html", 0, false},
+		{"format=xml", "", 0, "", 0, true},
+		{"sort=size&order=desc", "", 0, "html", 0, false},
+		{"sort=color", "", 0, "", 0, true},
+		{"order=random", "", 0, "", 0, true},
+		{"type=file", "", 0, "html", 0, false},
+		{"type=fifo", "", 0, "", 0, true},
+		{"glob=*.txt", "", 0, "html", 0, false},
+		{"glob=[", "", 0, "", 0, true},
+		{"limit=10", "", 0, "html", 10, false},
+		{"limit=10", "", 5, "html", 5, false},
+		{"", "", 5, "html", 5, false},
+		{"limit=0", "", 0, "", 0, true},
+		{"limit=a", "", 0, "", 0, true},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/dir/?"+test.query, nil)
+		req.Header.Set("Accept", test.accept)
+		q, err := parseListQuery(req, test.maxLimit)
+		if (err != nil) != test.err {
+			t.Errorf("bad error %v for %s", err, test.query)
+			continue
+		}
+		if err == nil && (q.format != test.format || q.limit != test.limit) {
+			t.Errorf("bad query %+v for %s", q, test.query)
+		}
+	}
+}
+
+func TestDirList_JSON(t *testing.T) {
+	rdir := "/tmp/tupitest-listing"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	createListingDir(rdir)
+	server := listingTestServer(rdir, "")
+
+	var tests = []struct {
+		query string
+		names []string
+	}{
+		{"format=json", []string{"a.txt", "b.tar.gz", "c#1.txt", "link", "sub"}},
+		{"format=json&order=desc", []string{"sub", "link", "c#1.txt", "b.tar.gz", "a.txt"}},
+		{"format=json&sort=size&type=file", []string{"b.tar.gz", "c#1.txt", "a.txt"}},
+		{"format=json&sort=size&type=file&order=desc", []string{"a.txt", "c#1.txt", "b.tar.gz"}},
+		{"format=json&sort=mtime&type=file", []string{"a.txt", "b.tar.gz", "c#1.txt"}},
+		{"format=json&type=dir", []string{"link", "sub"}},
+		{"format=json&glob=*.txt", []string{"a.txt", "c#1.txt"}},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/dir/?"+test.query, nil)
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("bad status %d for %s", w.Code, test.query)
+		}
+		var listing dirListing
+		err := json.Unmarshal(w.Body.Bytes(), &listing)
+		if err != nil {
+			t.Fatalf("bad json %s", err.Error())
+		}
+		names := make([]string, 0)
+		for _, e := range listing.Entries {
+			names = append(names, e.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.names, ",") {
+			t.Errorf("bad names %v for %s", names, test.query)
+		}
+		if listing.Path != "/dir/" {
+			t.Errorf("bad path %s", listing.Path)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/dir/", nil)
+	req.Header.Set("Accept", JSON_CONTENT_TYPE)
+	w := httptest.NewRecorder()
+	server.Servers[0].Server.Handler.ServeHTTP(w, req)
+	var listing dirListing
+	json.Unmarshal(w.Body.Bytes(), &listing)
+	for _, e := range listing.Entries {
+		switch e.Name {
+		case "a.txt":
+			if e.Type != "file" || e.Size != 3 || e.Symlink || e.Mtime.IsZero() {
+				t.Errorf("bad entry %+v", e)
+			}
+		case "link":
+			if e.Type != "dir" || !e.Symlink {
+				t.Errorf("bad entry %+v", e)
+			}
+		case "sub":
+			if e.Type != "dir" || e.Symlink {
+				t.Errorf("bad entry %+v", e)
+			}
+		}
+	}
+}
+
+func TestDirList_HTML(t *testing.T) {
+	rdir := "/tmp/tupitest-listing"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	createListingDir(rdir)
+	tmpl := filepath.Join(rdir, "listing.html")
+	os.WriteFile(tmpl, []byte(
+		`<h1>{{.Path}}</h1>{{range .Entries}}<a href="{{.URL}}">{{.Name}} {{.Size}}</a>{{end}}`), 0644)
+	bad := filepath.Join(rdir, "bad.html")
+	os.WriteFile(bad, []byte(`{{.Missing.Field}}`), 0644)
+
+	var tests = []struct {
+		tmpl   string
+		query  string
+		status int
+		body   string
+	}{
+		{"", "", 200, "<pre>\n<a href=\"a.txt\">a.txt</a>\n" +
+			"<a href=\"b.tar.gz\">b.tar.gz</a>\n<a href=\"c%231.txt\">c#1.txt</a>\n" +
+			"<a href=\"link/\">link/</a>\n<a href=\"sub/\">sub/</a>\n</pre>\n"},
+		{"", "type=dir&order=desc", 200,
+			"<pre>\n<a href=\"sub/\">sub/</a>\n<a href=\"link/\">link/</a>\n</pre>\n"},
+		{"", "sort=color", 400, "Invalid sort color\n"},
+		{tmpl, "glob=a*", 200, "<h1>/dir/</h1><a href=\"a.txt\">a.txt 3</a>"},
+		{bad, "", 500, "Internal Server Error\n"},
+	}
+	for _, test := range tests {
+		server := listingTestServer(rdir, test.tmpl)
+		req, _ := http.NewRequest("GET", "/dir/?"+test.query, nil)
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("bad status %d for %s %s", w.Code, test.tmpl, test.query)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("bad body %q for %s %s", w.Body.String(), test.tmpl, test.query)
+		}
+	}
+
+	// the template is parsed only once
+	os.WriteFile(tmpl, []byte(`changed`), 0644)
+	server := listingTestServer(rdir, tmpl)
+	req, _ := http.NewRequest("GET", "/dir/?glob=a*", nil)
+	w := httptest.NewRecorder()
+	server.Servers[0].Server.Handler.ServeHTTP(w, req)
+	if w.Body.String() != "<h1>/dir/</h1><a href=\"a.txt\">a.txt 3</a>" {
+		t.Errorf("template parsed again %q", w.Body.String())
+	}
+}
+
+func TestDirList_Pages(t *testing.T) {
+	rdir := "/tmp/tupitest-listing"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	createListingDir(rdir)
+	server := listingTestServer(rdir, "")
+
+	var tests = []struct {
+		query  string
+		status int
+		names  []string
+		next   string
+	}{
+		{"limit=2", 200, []string{"a.txt", "b.tar.gz"},
+			"/dir/?after=b.tar.gz&format=json&limit=2"},
+		{"limit=2&after=b.tar.gz", 200, []string{"c#1.txt", "link"},
+			"/dir/?after=link&format=json&limit=2"},
+		{"limit=2&after=link", 200, []string{"sub"}, ""},
+		{"limit=2&after=b", 200, []string{"b.tar.gz", "c#1.txt"},
+			"/dir/?after=c%231.txt&format=json&limit=2"},
+		{"limit=2&order=desc&after=link", 200, []string{"c#1.txt", "b.tar.gz"},
+			"/dir/?after=b.tar.gz&format=json&limit=2&order=desc"},
+		{"limit=1&sort=size&type=file", 200, []string{"b.tar.gz"},
+			"/dir/?after=b.tar.gz&after_key=1&format=json&limit=1&sort=size&type=file"},
+		{"limit=1&sort=size&type=file&after=b.tar.gz&after_key=1", 200, []string{"c#1.txt"},
+			"/dir/?after=c%231.txt&after_key=2&format=json&limit=1&sort=size&type=file"},
+		{"limit=1&sort=size&type=file&after=c%231.txt", 200, []string{"a.txt"}, ""},
+		{"limit=1&sort=size&order=desc&after=a.txt&after_key=3", 200, []string{"c#1.txt"},
+			"/dir/?after=c%231.txt&after_key=2&format=json&limit=1&order=desc&sort=size"},
+		// removed entries are found by the key
+		{"limit=1&sort=size&type=file&after=bb&after_key=1", 200, []string{"c#1.txt"},
+			"/dir/?after=c%231.txt&after_key=2&format=json&limit=1&sort=size&type=file"},
+		{"limit=1&sort=size&order=desc&type=file&after=bb&after_key=2", 200, []string{"b.tar.gz"}, ""},
+		{"limit=1&sort=size&after=missing", 400, nil, ""},
+		{"limit=1&sort=mtime&after=a.txt&after_key=x", 400, nil, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/dir/?format=json&"+test.query, nil)
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("bad status %d for %s", w.Code, test.query)
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+		var listing dirListing
+		json.Unmarshal(w.Body.Bytes(), &listing)
+		names := make([]string, 0)
+		for _, e := range listing.Entries {
+			names = append(names, e.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.names, ",") {
+			t.Errorf("bad names %v for %s", names, test.query)
+		}
+		if listing.Next != test.next {
+			t.Errorf("bad next %s for %s", listing.Next, test.query)
+		}
+		link := ""
+		if test.next != "" {
+			link = "<" + test.next + `>; rel="next"`
+		}
+		if w.Header().Get("Link") != link {
+			t.Errorf("bad link %s for %s", w.Header().Get("Link"), test.query)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/dir/?type=dir&limit=1", nil)
+	w := httptest.NewRecorder()
+	server.Servers[0].Server.Handler.ServeHTTP(w, req)
+	body := "<pre>\n<a href=\"link/\">link/</a>\n</pre>\n" +
+		"<a href=\"/dir/?after=link&amp;limit=1&amp;type=dir\" rel=\"next\">next</a>\n"
+	if w.Body.String() != body {
+		t.Errorf("bad html page %q", w.Body.String())
+	}
+}
+
+func TestListDir_Cache(t *testing.T) {
+	rdir := "/tmp/tupitest-listing"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	createListingDir(rdir)
+	dirPath := filepath.Join(rdir, "dir")
+
+	list := func() *cachedDir {
+		f, _ := os.Open(dirPath)
+		defer f.Close()
+		info, _ := f.Stat()
+		d, err := listDir(f, info, dirPath)
+		if err != nil {
+			t.Fatalf("error listing dir %s", err.Error())
+		}
+		return d
+	}
+	d := list()
+	if list() != d {
+		t.Fatalf("cache not used")
+	}
+	if len(d.sorted("name").entries) != 5 {
+		t.Fatalf("bad entries %+v", d.sorted("name").entries)
+	}
+
+	// the sorted views count for the size of the cache
+	if d.cost != 5 || d.sorted("size") == nil || d.cost != 10 {
+		t.Fatalf("bad cache cost %d", d.cost)
+	}
+	// changing a file in place does not change the directory
+	os.WriteFile(filepath.Join(dirPath, "a.txt"), []byte("aaaaaa"), 0644)
+	if list() != d {
+		t.Fatalf("cache not used")
+	}
+
+	// new files invalidate the cache
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(filepath.Join(dirPath, "d.txt"), []byte("d"), 0644)
+	os.Chtimes(dirPath, later, later)
+	d2 := list()
+	if d2 == d || len(d2.sorted("name").entries) != 6 {
+		t.Fatalf("cache not invalidated")
+	}
+}
+
+func TestDirCache(t *testing.T) {
+	c := newDirCache()
+	a := &cachedDir{path: "/a"}
+	b := &cachedDir{path: "/b"}
+	c.add(a, maxListCacheEntries-10)
+	c.add(b, 5)
+	if len(c.m) != 2 || c.entries != maxListCacheEntries-5 {
+		t.Fatalf("bad cache %d %d", len(c.m), c.entries)
+	}
+	// a dir listed again replaces the old one
+	b2 := &cachedDir{path: "/b"}
+	c.add(b2, 5)
+	if c.m["/b"] != b2 || c.entries != maxListCacheEntries-5 || c.lru.Len() != 2 {
+		t.Fatalf("bad cache after replace %d", c.entries)
+	}
+	// views of dirs not in the cache are not accounted
+	c.grow(b, 5)
+	if c.entries != maxListCacheEntries-5 {
+		t.Fatalf("view of old dir accounted %d", c.entries)
+	}
+	// a new view beyond the limit removes the least recently listed dir
+	c.get("/a")
+	cd := &cachedDir{path: "/c"}
+	c.add(cd, 3)
+	c.grow(cd, 3)
+	if _, ok := c.m["/b"]; ok || len(c.m) != 2 || c.entries != maxListCacheEntries-4 {
+		t.Fatalf("bad eviction %d %d", len(c.m), c.entries)
+	}
+	// a dir bigger than the cache is cached alone
+	big := &cachedDir{path: "/big"}
+	c.add(big, maxListCacheEntries+1)
+	if c.m["/big"] != big || len(c.m) != 1 || c.entries != maxListCacheEntries+1 {
+		t.Fatalf("bad cache with big dir %d %d", len(c.m), c.entries)
+	}
+	c.grow(big, maxListCacheEntries+1)
+	if c.m["/big"] != big {
+		t.Fatalf("big dir removed")
+	}
+}
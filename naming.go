@@ -0,0 +1,248 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Strategies to name the stored files. Anything with a placeholder,
+// like `{yyyy}/{uuid}{ext}`, is a template.
+const (
+	namingOriginal = "original"
+	namingRandom   = "random"
+	namingHash     = "hash"
+)
+
+// What to do when a file with the same name already exists.
+const (
+	collisionError     = "error"
+	collisionOverwrite = "overwrite"
+	collisionSuffix    = "suffix"
+)
+
+const INVALID_FNAME_MSG = "Invalid file name"
+
+// how many suffixes are tried before giving up
+const maxSuffix = 10000
+
+var placeholderRe = regexp.MustCompile(`\{[^}]*\}`)
+
+var templatePlaceholders = map[string]bool{
+	"{yyyy}":   true,
+	"{mm}":     true,
+	"{dd}":     true,
+	"{uuid}":   true,
+	"{name}":   true,
+	"{ext}":    true,
+	"{sha256}": true,
+}
+
+// isNamingTemplate informs if a naming strategy is a template.
+func isNamingTemplate(naming string) bool {
+	return strings.Contains(naming, "{")
+}
+
+// validateNaming checks if the naming strategy and the collision
+// policy are known.
+func validateNaming(naming string, collision string) error {
+	switch {
+	case naming == "" || naming == namingOriginal || naming == namingRandom ||
+		naming == namingHash:
+
+	case isNamingTemplate(naming):
+		for _, p := range placeholderRe.FindAllString(naming, -1) {
+			if !templatePlaceholders[p] {
+				return errors.New("Unknown placeholder " + p + " in file naming")
+			}
+		}
+		if filepath.IsAbs(naming) || containsDotDot(naming) {
+			return errors.New("Invalid file naming template " + naming)
+		}
+
+	default:
+		return errors.New("Unknown file naming " + naming)
+	}
+
+	switch collision {
+	case "", collisionError, collisionOverwrite, collisionSuffix:
+		return nil
+	}
+	return errors.New("Unknown collision policy " + collision)
+}
+
+// collisionPolicy returns the collision policy for a domain. Without
+// an explicit policy PreventOverwrite is used.
+func collisionPolicy(c *DomainConfig) string {
+	if valueOf(c.OnCollision) != "" {
+		return *c.OnCollision
+	}
+	if c.PreventOverwrite {
+		return collisionError
+	}
+	return collisionOverwrite
+}
+
+// storedName returns the name, relative to the upload dir, used to
+// store an uploaded file. Templates may create subdirectories.
+func storedName(f *uploadedFile, naming string, now time.Time) (string, error) {
+	switch {
+	case naming == "" || naming == namingOriginal:
+		return f.fname, nil
+
+	case naming == namingRandom:
+		return genRandFname(f.fname)
+
+	case naming == namingHash:
+		sum, err := f.contentSha256()
+		if err != nil {
+			return "", err
+		}
+		_, ext := splitExt(f.fname)
+		return sum + ext, nil
+	}
+
+	var err error
+	name, ext := splitExt(f.fname)
+	now = now.UTC()
+	fname := placeholderRe.ReplaceAllStringFunc(naming, func(p string) string {
+		switch p {
+		case "{yyyy}":
+			return fmt.Sprintf("%04d", now.Year())
+		case "{mm}":
+			return fmt.Sprintf("%02d", now.Month())
+		case "{dd}":
+			return fmt.Sprintf("%02d", now.Day())
+		case "{uuid}":
+			var id string
+			id, err = genUUID()
+			return id
+		case "{name}":
+			return name
+		case "{ext}":
+			return ext
+		case "{sha256}":
+			var sum string
+			sum, err = f.contentSha256()
+			return sum
+		}
+		// notest
+		return p
+	})
+	if err != nil {
+		// notest
+		return "", err
+	}
+	return filepath.FromSlash(strings.Trim(fname, "/")), nil
+}
+
+// contentSha256 returns the sha256 of the file, reading it from disk
+// if it was not computed while the file was received.
+func (f *uploadedFile) contentSha256() (string, error) {
+	if f.sha256 != "" {
+		return f.sha256, nil
+	}
+	fd, err := os.Open(f.tmpPath)
+	if err != nil {
+		// notest
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, fd)
+	if err != nil {
+		// notest
+		return "", err
+	}
+	f.sha256 = hex.EncodeToString(h.Sum(nil))
+	return f.sha256, nil
+}
+
+// splitExt splits a file name in its name and extension. Compressed
+// tar files, like `file.tar.gz`, have a double extension.
+func splitExt(fname string) (string, string) {
+	ext := filepath.Ext(fname)
+	name := strings.TrimSuffix(fname, ext)
+	if tarExt := filepath.Ext(name); strings.ToLower(tarExt) == ".tar" {
+		ext = tarExt + ext
+		name = strings.TrimSuffix(name, tarExt)
+	}
+	return name, ext
+}
+
+// storeWithSuffix stores the file using the first free name in the
+// form `name (n).ext`. The file is hard linked to the new name so
+// an existing file is never replaced. Returns the path of the stored file.
+func storeWithSuffix(tmpPath string, fpath string) (string, error) {
+	name, ext := splitExt(fpath)
+	for i := 1; i <= maxSuffix; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", name, i, ext)
+		err := os.Link(tmpPath, candidate)
+		if os.IsExist(err) {
+			continue
+		}
+		if errors.Is(err, syscall.EXDEV) {
+			// the file is linked from a copy in the same file system
+			copied, err := copyTempFile(tmpPath, filepath.Dir(fpath))
+			if err != nil {
+				// notest
+				return "", err
+			}
+			stored, err := storeWithSuffix(copied, fpath)
+			if err != nil {
+				// notest
+				os.Remove(copied)
+				return "", err
+			}
+			os.Remove(tmpPath)
+			return stored, nil
+		}
+		if err != nil {
+			// notest
+			return "", err
+		}
+		os.Remove(tmpPath)
+		return candidate, nil
+	}
+	// notest
+	return "", errors.New("File " + filepath.Base(fpath) + " already exists")
+}
+
+// genUUID returns a random (version 4) uuid.
+func genUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		// notest
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateNaming(t *testing.T) {
+	var tests = []struct {
+		naming    string
+		collision string
+		ok        bool
+	}{
+		{"", "", true},
+		{namingHash, collisionSuffix, true},
+		{"{yyyy}/{mm}/{uuid}{ext}", collisionError, true},
+		{"something", "", false},
+		{"{yyyy}/{bad}", "", false},
+		{"../{name}{ext}", "", false},
+		{namingRandom, "bad", false},
+	}
+	for _, test := range tests {
+		err := validateNaming(test.naming, test.collision)
+		if (err == nil) != test.ok {
+			t.Errorf("bad result for %s %s: %v", test.naming, test.collision, err)
+		}
+	}
+}
+
+func TestStoredName(t *testing.T) {
+	dir := "/tmp/tupitest"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "tmp")
+	os.WriteFile(tmpPath, []byte("oi"), 0644)
+	sum := "87f633634cc4b02f628685651f0a29b7bfa22a0bd841f725c6772dd00a58d489"
+	now := time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		fname  string
+		naming string
+		re     string
+	}{
+		{"file.txt", namingOriginal, `^file\.txt$`},
+		{"file.txt", namingRandom, `^[0-9a-f]{16}-file\.txt$`},
+		{"file.tar.gz", namingHash, "^" + sum + `\.tar\.gz$`},
+		{"file.txt", "{yyyy}/{mm}/{dd}/{name}{ext}", `^2026/03/04/file\.txt$`},
+		{"file.txt", "{uuid}{ext}", `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\.txt$`},
+		{"file", "{sha256}{ext}", "^" + sum + "$"},
+	}
+	for _, test := range tests {
+		f := &uploadedFile{tmpPath: tmpPath, fname: test.fname}
+		name, err := storedName(f, test.naming, now)
+		if err != nil {
+			t.Fatalf("error naming %s: %s", test.fname, err)
+		}
+		if !regexp.MustCompile(test.re).MatchString(filepath.ToSlash(name)) {
+			t.Errorf("bad name %s for %s", name, test.naming)
+		}
+	}
+}
+
+func TestStoreFile_Collision(t *testing.T) {
+	dir := "/tmp/tupitest"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		fname       string
+		naming      string
+		collision   string
+		path        string
+		overwritten bool
+		has_err     bool
+	}{
+		{"a.tar.gz", namingOriginal, collisionSuffix, "a.tar.gz", false, false},
+		{"a.tar.gz", namingOriginal, collisionSuffix, "a (1).tar.gz", false, false},
+		{"a.tar.gz", namingOriginal, collisionSuffix, "a (2).tar.gz", false, false},
+		{"a.tar.gz", namingOriginal, collisionOverwrite, "a.tar.gz", true, false},
+		{"a.tar.gz", namingOriginal, collisionError, "", false, true},
+		{"b.txt", namingHash, collisionError, "", false, false},
+		// same content, already stored
+		{"c.txt", namingHash, collisionError, "", false, false},
+		{".tupi", namingOriginal, collisionOverwrite, "", false, true},
+	}
+	for _, test := range tests {
+		f, err := writeTempFile(dir, strings.NewReader("oi"))
+		if err != nil {
+			t.Fatalf("error writing temp file %s", err)
+		}
+		f.fname = test.fname
+		opts := uploadOptions{naming: test.naming, collision: test.collision}
+		r := storeFile(dir, "pre", f, opts)
+		if (r.err != nil) != test.has_err {
+			t.Fatalf("bad error for %s: %v", test.path, r.err)
+		}
+		if test.path != "" && r.path != "pre/"+test.path {
+			t.Errorf("bad path %s, expected %s", r.path, test.path)
+		}
+		if r.overwritten != test.overwritten {
+			t.Errorf("bad overwritten for %s", r.path)
+		}
+		f.discard()
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "pre"))
+	if len(entries) != 4 {
+		t.Errorf("bad number of files %d", len(entries))
+	}
+}
+
+func TestStoreFile_OtherFileSystem(t *testing.T) {
+	// tmpfs is another file system than /tmp
+	mnt := "/dev/shm/tupitest-mnt"
+	if err := os.MkdirAll(mnt, 0755); err != nil {
+		t.Skip("no /dev/shm")
+	}
+	defer os.RemoveAll(mnt)
+	dir := "/tmp/tupitest"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	os.Symlink(mnt, filepath.Join(dir, "mnt"))
+
+	var tests = []struct {
+		collision string
+		path      string
+	}{
+		{collisionOverwrite, "a.txt"},
+		{collisionOverwrite, "a.txt"},
+		{collisionSuffix, "a (1).txt"},
+	}
+	for _, test := range tests {
+		f, _ := writeTempFile(dir, strings.NewReader("oi"))
+		f.fname = "a.txt"
+		r := storeFile(dir, "mnt", f, uploadOptions{collision: test.collision})
+		if r.err != nil || r.path != "mnt/"+test.path {
+			t.Fatalf("bad result %s %v", r.path, r.err)
+		}
+		b, _ := os.ReadFile(filepath.Join(mnt, test.path))
+		if string(b) != "oi" {
+			t.Errorf("bad content %q", b)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temp files left %d", len(entries))
+	}
+	entries, _ = os.ReadDir(mnt)
+	if len(entries) != 2 {
+		t.Errorf("bad number of files %d", len(entries))
+	}
+}
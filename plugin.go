@@ -25,9 +25,13 @@ import (
 )
 
 type AuthFn func(*http.Request, string, *map[string]any) (bool, int)
+
+// AuthUserFn is an authentication function that also returns the
+// identity of the authenticated user.
+type AuthUserFn func(*http.Request, string, *map[string]any) (bool, int, string)
 type ServeFn func(http.ResponseWriter, *http.Request, *map[string]any)
 
-var authPluginsCache map[string]AuthFn = make(map[string]AuthFn)
+var authPluginsCache map[string]AuthUserFn = make(map[string]AuthUserFn)
 var servePluginsCache map[string]ServeFn = make(map[string]ServeFn)
 
 // InitPlugin tries to run the “Init“ function of a plugin. As it is
@@ -72,7 +76,12 @@ func InitPlugin(fpath string, domain string, conf *map[string]any) (*plugin.Plug
 // config map for the domain as parameters.
 // The signature of the “Authenticate“ function is as follows:
 //
-//	func(*http.Request, string, map[string]any)
+//	func(*http.Request, string, map[string]any) (bool, int)
+//
+// The “Authenticate“ function may also return the identity of the
+// authenticated user. In this case the signature is:
+//
+//	func(*http.Request, string, map[string]any) (bool, int, string)
 //
 // LoadAuthPlugin is intended to be run as part of the server start process.
 func LoadAuthPlugin(fpath string, domain string, conf *map[string]any) error {
@@ -85,12 +94,19 @@ func LoadAuthPlugin(fpath string, domain string, conf *map[string]any) error {
 	if err != nil {
 		return err
 	}
-	fn, ok := s.(func(*http.Request, string, *map[string]any) (bool, int))
-	if !ok {
+	switch fn := s.(type) {
+	case func(*http.Request, string, *map[string]any) (bool, int, string):
+		authPluginsCache[fpath] = fn
+
+	case func(*http.Request, string, *map[string]any) (bool, int):
+		authPluginsCache[fpath] = func(r *http.Request, domain string, conf *map[string]any) (bool, int, string) {
+			ok, status := fn(r, domain, conf)
+			return ok, status, ""
+		}
+
+	default:
 		return errors.New("Invalid Authenticate symbol for plugin: " + fpath)
 	}
-
-	authPluginsCache[fpath] = fn
 	return nil
 }
 
@@ -123,6 +139,21 @@ func LoadServePlugin(fpath string, domain string, conf *map[string]any) error {
 
 // Returns an already loaded “Autenticate“ function of an auth plugin.
 func GetAuthPlugin(fpath string) (AuthFn, error) {
+	fn, err := GetAuthUserPlugin(fpath)
+	if err != nil {
+		return nil, err
+	}
+	authFn := func(r *http.Request, domain string, conf *map[string]any) (bool, int) {
+		ok, status, _ := fn(r, domain, conf)
+		return ok, status
+	}
+	return authFn, nil
+}
+
+// Returns an already loaded “Autenticate“ function of an auth plugin
+// that also returns the identity of the authenticated user. For plugins
+// that don't return the identity it is always an empty string.
+func GetAuthUserPlugin(fpath string) (AuthUserFn, error) {
 	if fn, exists := authPluginsCache[fpath]; exists {
 		return fn, nil
 	}
@@ -0,0 +1,382 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const QUOTA_EXCEEDED_MSG = "Quota exceeded"
+
+// max age of the disk usage kept in memory. The usage is updated when
+// tupi stores a file but the files may be changed by other means, so
+// the directory is walked again after this.
+const maxUsageAge = 5 * time.Minute
+
+// quota keeps the disk usage of a directory and its limits. A zero
+// limit means no limit.
+type quota struct {
+	maxBytes int64
+	maxFiles int64
+	bytes    int64
+	files    int64
+	// the root dir of the domain, where the internal files are.
+	root string
+	// the dir the quota applies to.
+	dir string
+	// replaced files are kept as versions.
+	versions bool
+}
+
+// usage is the disk usage of a quota dir kept in memory so the dir is
+// not walked for every upload. It is only changed with the lock
+// of the dir usage.
+type usage struct {
+	bytes int64
+	files int64
+	at    time.Time
+}
+
+var usages = struct {
+	sync.Mutex
+	m map[string]*usage
+}{m: make(map[string]*usage)}
+
+// usageJSON is the response of the usage endpoint.
+type usageJSON struct {
+	Bytes      int64 `json:"bytes"`
+	Files      int64 `json:"files"`
+	QuotaBytes int64 `json:"quotaBytes"`
+	QuotaFiles int64 `json:"quotaFiles"`
+}
+
+func hasQuota(c *DomainConfig) bool {
+	return c.QuotaBytes > 0 || c.QuotaFiles > 0
+}
+
+// quotaDir returns the directory the quota applies to for a request.
+func quotaDir(req *http.Request, c *DomainConfig) (string, error) {
+	if !c.QuotaPerUser {
+		return c.RootDir, nil
+	}
+	dir, _, err := uploadDir(req, c)
+	return dir, err
+}
+
+// requestQuota returns the quota for the files uploaded in a request
+// or nil if the domain has no quota.
+func requestQuota(req *http.Request, c *DomainConfig) (*quota, error) {
+	if !hasQuota(c) {
+		return nil, nil
+	}
+	dir, err := quotaDir(req, c)
+	if err != nil {
+		return nil, err
+	}
+	return newQuota(dir, c)
+}
+
+// newQuota returns the quota of a domain with the current usage
+// of `dir`.
+func newQuota(dir string, c *DomainConfig) (*quota, error) {
+	if !hasQuota(c) {
+		return nil, nil
+	}
+	q := &quota{
+		maxBytes: c.QuotaBytes,
+		maxFiles: c.QuotaFiles,
+		root:     realPath(c.RootDir),
+		dir:      realPath(dir),
+		versions: c.KeepVersions > 0,
+	}
+	var err error
+	q.bytes, q.files, err = currentUsage(q.root, q.dir)
+	if err != nil {
+		// notest
+		return nil, err
+	}
+	return q, nil
+}
+
+// realPath returns `fpath` with its links resolved or `fpath` itself
+// if it does not exist. The root dir may be a link to a release.
+func realPath(fpath string) string {
+	resolved, err := filepath.EvalSymlinks(fpath)
+	if err != nil {
+		return fpath
+	}
+	return resolved
+}
+
+// usageLockKey returns the key of the lock for the usage of `dir`.
+func usageLockKey(dir string) string {
+	return "usage:" + dir
+}
+
+// loadUsage returns the usage of `dir` kept in memory, walking the
+// dir if needed. It must be called with the lock for the dir usage.
+func loadUsage(root string, dir string) (*usage, error) {
+	usages.Lock()
+	u, ok := usages.m[dir]
+	usages.Unlock()
+	if ok && time.Since(u.at) < maxUsageAge {
+		return u, nil
+	}
+	bytes, files, err := quotaUsage(root, dir)
+	if err != nil {
+		// notest
+		return nil, err
+	}
+	u = &usage{bytes: bytes, files: files, at: time.Now()}
+	usages.Lock()
+	usages.m[dir] = u
+	usages.Unlock()
+	return u, nil
+}
+
+// currentUsage returns the size and the number of files of `dir`.
+func currentUsage(root string, dir string) (int64, int64, error) {
+	key := usageLockKey(dir)
+	AcquireLock(key)
+	defer ReleaseLock(key)
+
+	u, err := loadUsage(root, dir)
+	if err != nil {
+		// notest
+		return 0, 0, err
+	}
+	return u.bytes, u.files, nil
+}
+
+// forgetUsage discards the usage kept for the dirs that contain
+// `fpath` so they are walked again. It is used when files are removed.
+func forgetUsage(fpath string) {
+	fpath = filepath.Join(realPath(filepath.Dir(fpath)), filepath.Base(fpath))
+	usages.Lock()
+	defer usages.Unlock()
+	for dir := range usages.m {
+		if isWithinDir(dir, fpath) || isWithinDir(fpath, dir) {
+			delete(usages.m, dir)
+		}
+	}
+}
+
+// quotaUsage returns the size and the number of files of a quota dir.
+// The internal files of the files inside `dir`, like its versions,
+// count for the size even if they are in the internal dir of `root`.
+func quotaUsage(root string, dir string) (int64, int64, error) {
+	size, count, err := diskUsage(dir)
+	if err != nil {
+		// notest
+		return 0, 0, err
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." || !isWithinDir(root, dir) {
+		return size, count, nil
+	}
+	for _, name := range []string{metaDirName, versionsDirName} {
+		isize, _, err := diskUsage(filepath.Join(root, internalDirName, name, rel))
+		if err != nil {
+			// notest
+			return 0, 0, err
+		}
+		size += isize
+	}
+	return size, count, nil
+}
+
+// diskUsage returns the size and the number of the regular files
+// inside a directory. The internal tupi files, like versions and
+// temporary files, count for the size but are not counted as files.
+func diskUsage(dir string) (int64, int64, error) {
+	var size, count int64
+	// the root dir may be a link to a release
+	dir = realPath(dir)
+	err := filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			// notest
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// notest
+			return nil
+		}
+		size += info.Size()
+		rel, _ := filepath.Rel(dir, fpath)
+		if !isInternalPath(rel) {
+			count++
+		}
+		return nil
+	})
+	return size, count, err
+}
+
+// check informs if there is room for `size` more bytes. A negative
+// size, like an unknown content length, only checks if the quota
+// was already exceeded. The number of files is only checked when
+// the file is stored as it may replace an existing one.
+func (q *quota) check(size int64) error {
+	if q == nil {
+		return nil
+	}
+	if size < 0 {
+		size = 0
+	}
+	if q.maxBytes > 0 && q.bytes+size > q.maxBytes {
+		return errors.New(QUOTA_EXCEEDED_MSG)
+	}
+	return nil
+}
+
+// credit returns the bytes released when the file in `fpath` is
+// replaced. Nothing is released if the old content is kept as a version.
+func (q *quota) credit(fpath string) int64 {
+	if q == nil || q.versions {
+		return 0
+	}
+	st, err := os.Lstat(fpath)
+	if err != nil || !st.Mode().IsRegular() {
+		return 0
+	}
+	return st.Size()
+}
+
+// maxCredit returns the most bytes that can be released when a file
+// is replaced, for when the file is not known yet.
+func (q *quota) maxCredit() int64 {
+	if q == nil || q.versions {
+		return 0
+	}
+	return q.bytes
+}
+
+// reserve accounts a file of `size` bytes stored in `fpath` if it
+// fits the quota. When an existing file is replaced only the difference
+// of size is accounted and the number of files does not change. An
+// empty `fpath` means a new file.
+func (q *quota) reserve(fpath string, size int64) error {
+	if q == nil {
+		return nil
+	}
+	key := usageLockKey(q.dir)
+	AcquireLock(key)
+	defer ReleaseLock(key)
+
+	u, err := loadUsage(q.root, q.dir)
+	if err != nil {
+		// notest
+		return err
+	}
+	bytes, files := size, int64(1)
+	if st, err := os.Lstat(fpath); err == nil && st.Mode().IsRegular() {
+		bytes -= q.credit(fpath)
+		files = 0
+	}
+	if q.maxBytes > 0 && bytes > 0 && u.bytes+bytes > q.maxBytes {
+		return errors.New(QUOTA_EXCEEDED_MSG)
+	}
+	if q.maxFiles > 0 && files > 0 && u.files+files > q.maxFiles {
+		return errors.New(QUOTA_EXCEEDED_MSG)
+	}
+	u.bytes += bytes
+	u.files += files
+	q.bytes, q.files = u.bytes, u.files
+	return nil
+}
+
+// forget discards the usage kept for the quota dir. It is used when
+// a reserved file could not be stored.
+func (q *quota) forget() {
+	if q == nil {
+		return
+	}
+	forgetUsage(q.dir)
+}
+
+// limitReader returns a reader that fails when more bytes than the
+// quota allows are read from `r`. `pending` are bytes already received
+// but not yet accounted in the quota.
+func (q *quota) limitReader(r io.Reader, pending int64) io.Reader {
+	if q == nil || q.maxBytes <= 0 {
+		return r
+	}
+	return &quotaReader{Reader: r, remaining: q.maxBytes - q.bytes - pending}
+}
+
+type quotaReader struct {
+	io.Reader
+	remaining int64
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, errors.New(QUOTA_EXCEEDED_MSG)
+	}
+	// reads one byte more than allowed to know if the limit was passed.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.Reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, errors.New(QUOTA_EXCEEDED_MSG)
+	}
+	return n, err
+}
+
+// showUsage returns the disk usage of the domain, or of the user when
+// the quota is per user.
+func showUsage(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
+	if req.Method != http.MethodGet {
+		writeError(w, req, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed,
+			"Method not allowed")
+		return
+	}
+	dir, err := quotaDir(req, c)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	size, count, err := currentUsage(realPath(c.RootDir), realPath(dir))
+	if err != nil {
+		// notest
+		writeUploadError(w, req, err)
+		return
+	}
+	resp := usageJSON{
+		Bytes:      size,
+		Files:      count,
+		QuotaBytes: c.QuotaBytes,
+		QuotaFiles: c.QuotaFiles,
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
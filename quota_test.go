@@ -0,0 +1,294 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	dir := "/tmp/tupitest"
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	os.MkdirAll(filepath.Join(dir, internalDirName), 0755)
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "x.txt"), []byte("123"), 0644)
+	os.WriteFile(filepath.Join(dir, "a", "b", "y.txt"), []byte("12345"), 0644)
+	os.WriteFile(filepath.Join(dir, internalDirName, "z"), []byte("12345"), 0644)
+	os.WriteFile(filepath.Join(dir, ".tupi-upload-1"), []byte("12345"), 0644)
+	os.Symlink(filepath.Join(dir, "x.txt"), filepath.Join(dir, "link"))
+
+	size, count, err := diskUsage(dir)
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	// internal files count for the size but are not files
+	if size != 18 || count != 2 {
+		t.Errorf("bad usage %d %d", size, count)
+	}
+
+	size, count, err = diskUsage(filepath.Join(dir, "missing"))
+	if err != nil || size != 0 || count != 0 {
+		t.Errorf("bad usage for missing dir %d %d %v", size, count, err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	dir := "/tmp/tupitest"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	defer forgetUsage(dir)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("12345"), 0644)
+
+	var q *quota
+	if q.reserve("", 100) != nil || q.check(100) != nil {
+		t.Errorf("nil quota has limits")
+	}
+
+	c := &DomainConfig{RootDir: dir, QuotaBytes: 10, QuotaFiles: 2}
+	q, _ = newQuota(dir, c)
+	if q.bytes != 5 || q.files != 1 {
+		t.Fatalf("bad usage %d %d", q.bytes, q.files)
+	}
+	if q.check(6) == nil {
+		t.Errorf("too many bytes accepted")
+	}
+	// an overwrite only reserves the difference of size
+	if err := q.reserve(filepath.Join(dir, "a.txt"), 10); err != nil {
+		t.Errorf("error reserving overwrite %s", err)
+	}
+	if q.bytes != 10 || q.files != 1 {
+		t.Errorf("bad usage after overwrite %d %d", q.bytes, q.files)
+	}
+	if err := q.reserve(filepath.Join(dir, "a.txt"), 1); err != nil {
+		t.Errorf("error reserving smaller overwrite %s", err)
+	}
+	if err := q.reserve(filepath.Join(dir, "b.txt"), 0); err != nil {
+		t.Errorf("error reserving %s", err)
+	}
+	if q.reserve("", 0) == nil {
+		t.Errorf("too many files accepted")
+	}
+
+	// the usage is kept between requests
+	other, _ := newQuota(dir, c)
+	if other.bytes != 6 || other.files != 2 {
+		t.Errorf("usage not kept %d %d", other.bytes, other.files)
+	}
+	other.forget()
+	other, _ = newQuota(dir, c)
+	if other.bytes != 5 || other.files != 1 {
+		t.Errorf("usage not walked again %d %d", other.bytes, other.files)
+	}
+
+	// the old content is kept when the quota has versions
+	c.KeepVersions = 1
+	q, _ = newQuota(dir, c)
+	if q.reserve(filepath.Join(dir, "a.txt"), 6) == nil {
+		t.Errorf("versioned overwrite reserved the difference of size")
+	}
+
+	q = &quota{maxBytes: 10, bytes: 5}
+	_, err := io.ReadAll(q.limitReader(strings.NewReader("12345"), 0))
+	if err != nil {
+		t.Errorf("error reading %s", err)
+	}
+	_, err = io.ReadAll(q.limitReader(strings.NewReader("12345"), 1))
+	if err == nil || err.Error() != QUOTA_EXCEEDED_MSG {
+		t.Errorf("bad error %v", err)
+	}
+}
+
+func TestQuotaUsage_Internal(t *testing.T) {
+	root := "/tmp/tupitest"
+	vdir := filepath.Join(root, internalDirName, versionsDirName, "test", "a.txt"+versionsDirSuffix)
+	os.MkdirAll(vdir, 0755)
+	os.MkdirAll(filepath.Join(root, "test"), 0755)
+	defer os.RemoveAll(root)
+	os.WriteFile(filepath.Join(root, "test", "a.txt"), []byte("123"), 0644)
+	os.WriteFile(filepath.Join(vdir, "1"), []byte("12345"), 0644)
+	os.WriteFile(filepath.Join(vdir, "2"), []byte("12345"), 0644)
+
+	var tests = []struct {
+		dir   string
+		size  int64
+		count int64
+	}{
+		{root, 13, 1},
+		{filepath.Join(root, "test"), 13, 1},
+		{filepath.Join(root, "other"), 0, 0},
+	}
+	for _, test := range tests {
+		size, count, err := quotaUsage(root, test.dir)
+		if err != nil || size != test.size || count != test.count {
+			t.Errorf("bad usage for %s: %d %d %v", test.dir, size, count, err)
+		}
+	}
+}
+
+func TestRecieveFile_Quota(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	defer forgetUsage(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		UsagePath:     "/usage",
+		MaxUploadSize: 1000,
+		AllowPut:      true,
+		QuotaBytes:    10,
+		QuotaFiles:    3,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+	handler := server.Servers[0].Server.Handler
+
+	var tests = []struct {
+		fnames   []string
+		contents []string
+		status   int
+	}{
+		{[]string{"a.txt"}, []string{"12345"}, 201},
+		{[]string{"b.txt"}, []string{"123456"}, 507},
+		{[]string{"b.txt", "c.txt"}, []string{"123", "12"}, 201},
+		{[]string{"d.txt"}, []string{""}, 507},
+	}
+	for _, test := range tests {
+		buf, boundary, _ := createMultiFileBufferReader(
+			test.fnames, test.contents, "")
+		req, _ := http.NewRequest("POST", "/u/", buf)
+		req.Host = "localhost:8000"
+		req.SetBasicAuth("test", "123")
+		req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s", w.Code, test.status, test.fnames)
+		}
+	}
+	if fileExists(filepath.Join(rdir, "b.txt")) && fileExists(filepath.Join(rdir, "d.txt")) {
+		t.Errorf("file stored over the quota")
+	}
+
+	req, _ := http.NewRequest("PUT", "/e.txt", strings.NewReader("1"))
+	req.SetBasicAuth("test", "123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 507 {
+		t.Errorf("got %d for put over the quota", w.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/usage", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Errorf("usage not authenticated %d", w.Code)
+	}
+	req.SetBasicAuth("test", "123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	usage := usageJSON{}
+	json.Unmarshal(w.Body.Bytes(), &usage)
+	expected := usageJSON{Bytes: 10, Files: 3, QuotaBytes: 10, QuotaFiles: 3}
+	if w.Code != 200 || usage != expected {
+		t.Errorf("bad usage %d %+v", w.Code, usage)
+	}
+
+	// the quota is full but files can be replaced
+	req, _ = http.NewRequest("PUT", "/a.txt", strings.NewReader("123"))
+	req.SetBasicAuth("test", "123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 204 {
+		t.Errorf("got %d replacing a file with the quota full", w.Code)
+	}
+	buf, boundary, _ := createMultiFileBufferReader(
+		[]string{"a.txt"}, []string{"12345"}, "")
+	req, _ = http.NewRequest("POST", "/u/", buf)
+	req.SetBasicAuth("test", "123")
+	req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Errorf("got %d replacing a file with a bigger one", w.Code)
+	}
+	q, _ := newQuota(rdir, &dconf)
+	if q.bytes != 10 || q.files != 3 {
+		t.Errorf("bad usage after replacing %d %d", q.bytes, q.files)
+	}
+
+	// the prefix of the replaced file is sent after the file
+	os.Remove(filepath.Join(rdir, "c.txt"))
+	os.MkdirAll(filepath.Join(rdir, "pre"), 0755)
+	os.WriteFile(filepath.Join(rdir, "pre", "file.txt"), []byte("12"), 0644)
+	forgetUsage(rdir)
+	buf, boundary, _ = createBufferMultipartReader("file.txt", "21", "pre")
+	req, _ = http.NewRequest("POST", "/u/", buf)
+	req.SetBasicAuth("test", "123")
+	req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Errorf("got %d replacing a file with the prefix after it", w.Code)
+	}
+}
+
+func TestRecieveAndExtract_Quota(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	defer forgetUsage(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 10 << 20,
+		QuotaFiles:    1,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	b, _ := os.ReadFile("./testdata/test.tar.gz")
+	pr, boundary, _ := createMultipartPipeReader("test.tar.gz", b)
+	req, _ := http.NewRequest("POST", "/e/", pr)
+	req.SetBasicAuth("test", "123")
+	req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+	w := httptest.NewRecorder()
+	server.Servers[0].Server.Handler.ServeHTTP(w, req)
+	if w.Code != 507 {
+		t.Errorf("got %d extracting over the quota", w.Code)
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const JSON_CONTENT_TYPE = "application/json"
+
+// Machine readable error codes used in the json responses
+const (
+	ErrCodeInvalidPrefix      = "INVALID_PREFIX"
+	ErrCodeAlreadyExists      = "ALREADY_EXISTS"
+	ErrCodeIsDirectory        = "IS_DIRECTORY"
+	ErrCodeNoFile             = "NO_FILE"
+	ErrCodeChecksumMismatch   = "CHECKSUM_MISMATCH"
+	ErrCodeInvalidDigest      = "INVALID_DIGEST"
+	ErrCodeTooLarge           = "TOO_LARGE"
+	ErrCodeUnsupportedType    = "UNSUPPORTED_TYPE"
+	ErrCodeInvalidFileName    = "INVALID_FILE_NAME"
+	ErrCodeQuotaExceeded      = "QUOTA_EXCEEDED"
+	ErrCodeInvalidExpires     = "INVALID_EXPIRES"
+	ErrCodePreconditionFailed = "PRECONDITION_FAILED"
+	ErrCodeUnsupportedArchive = "UNSUPPORTED_ARCHIVE"
+	ErrCodeUnauthorized       = "UNAUTHORIZED"
+	ErrCodeForbidden          = "FORBIDDEN"
+	ErrCodeMethodNotAllowed   = "METHOD_NOT_ALLOWED"
+	ErrCodeBadContentType     = "BAD_CONTENT_TYPE"
+	ErrCodeBadRequest         = "BAD_REQUEST"
+	ErrCodeInternalError      = "INTERNAL_ERROR"
+	ErrCodeNotFound           = "NOT_FOUND"
+	ErrCodeConflict           = "CONFLICT"
+)
+
+type errorJSON struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"`
+}
+
+type fileJSON struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Sha256      string `json:"sha256,omitempty"`
+	Overwritten bool   `json:"overwritten"`
+	URL         string `json:"url"`
+}
+
+type uploadResponseJSON struct {
+	Files  []fileJSON  `json:"files"`
+	Errors []errorJSON `json:"errors,omitempty"`
+}
+
+// wantsJSON informs if the client accepts json responses.
+func wantsJSON(req *http.Request) bool {
+	for _, v := range strings.Split(req.Header.Get("Accept"), ",") {
+		mtype, _, err := mime.ParseMediaType(v)
+		if err == nil && mtype == JSON_CONTENT_TYPE {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON writes `v` as the json body of the response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// notest
+		Errorf("%s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+// writeError writes an error response. If the client accepts json the
+// body is a json object with the error code and message, otherwise
+// it is the plain text message.
+func writeError(w http.ResponseWriter, req *http.Request, status int, code string, msg string) {
+	if !wantsJSON(req) {
+		http.Error(w, msg, status)
+		return
+	}
+	body := map[string]errorJSON{
+		"error": {Code: code, Message: msg},
+	}
+	writeJSON(w, status, body)
+}
+
+// writeHTTPError writes the response for an error accessing a file in
+// the local fs.
+func writeHTTPError(w http.ResponseWriter, req *http.Request, err error) {
+	msg, status := toHTTPError(err)
+	writeError(w, req, status, statusErrorCode(status), msg)
+}
+
+// writeUploadError writes the response for an error while storing
+// uploaded files.
+func writeUploadError(w http.ResponseWriter, req *http.Request, err error) {
+	status, code := uploadErrorCode(err)
+	msg := err.Error()
+	if status == http.StatusInternalServerError {
+		// notest
+		Errorf("%s\n", err.Error())
+		msg = "Internal Server Error"
+	}
+	writeError(w, req, status, code, msg)
+}
+
+// uploadErrorCode returns the http status and the error code for
+// an error storing uploaded files.
+func uploadErrorCode(err error) (int, string) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge, ErrCodeTooLarge
+	}
+	msg := err.Error()
+	switch {
+	case msg == INVALID_PREFIX_MSG:
+		return http.StatusBadRequest, ErrCodeInvalidPrefix
+
+	case msg == NO_FILE_MSG:
+		return http.StatusBadRequest, ErrCodeNoFile
+
+	case msg == CHECKSUM_MISMATCH_MSG:
+		return http.StatusBadRequest, ErrCodeChecksumMismatch
+
+	case msg == INVALID_DIGEST_MSG:
+		return http.StatusBadRequest, ErrCodeInvalidDigest
+
+	case strings.Contains(msg, "already exists"):
+		return http.StatusBadRequest, ErrCodeAlreadyExists
+
+	case strings.Contains(msg, "is a directory"):
+		return http.StatusBadRequest, ErrCodeIsDirectory
+
+	case strings.HasPrefix(msg, UNSUPPORTED_TYPE_MSG):
+		return http.StatusUnsupportedMediaType, ErrCodeUnsupportedType
+
+	case msg == UNSUPPORTED_ARCHIVE_MSG,
+		strings.HasPrefix(msg, UNSUPPORTED_ENTRY_MSG):
+		return http.StatusUnsupportedMediaType, ErrCodeUnsupportedArchive
+
+	case strings.HasPrefix(msg, INVALID_ENTRY_MSG):
+		return http.StatusBadRequest, ErrCodeInvalidFileName
+
+	case strings.HasPrefix(msg, EXTRACT_LIMIT_MSG):
+		return http.StatusRequestEntityTooLarge, ErrCodeTooLarge
+
+	case msg == INVALID_EXPIRES_MSG:
+		return http.StatusBadRequest, ErrCodeInvalidExpires
+
+	case msg == INVALID_FNAME_MSG:
+		return http.StatusBadRequest, ErrCodeInvalidFileName
+
+	case msg == QUOTA_EXCEEDED_MSG:
+		return http.StatusInsufficientStorage, ErrCodeQuotaExceeded
+
+	case msg == NO_USER_MSG:
+		return http.StatusForbidden, ErrCodeForbidden
+
+	case msg == NO_RELEASE_MSG:
+		return http.StatusNotFound, ErrCodeNotFound
+
+	case msg == NOT_RELEASE_ROOT_MSG:
+		return http.StatusConflict, ErrCodeConflict
+
+	case msg == PRECONDITION_FAILED_MSG:
+		return http.StatusPreconditionFailed, ErrCodePreconditionFailed
+	}
+	return http.StatusInternalServerError, ErrCodeInternalError
+}
+
+// statusErrorCode returns a generic error code for a http status.
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+
+	case http.StatusMethodNotAllowed:
+		return ErrCodeMethodNotAllowed
+
+	case http.StatusRequestEntityTooLarge:
+		return ErrCodeTooLarge
+
+	case http.StatusBadRequest:
+		return ErrCodeBadRequest
+
+	case http.StatusInsufficientStorage:
+		return ErrCodeQuotaExceeded
+
+	case http.StatusConflict:
+		return ErrCodeConflict
+	}
+	return ErrCodeInternalError
+}
+
+// writeUploadResults writes the response for the files stored by
+// an upload.
+func writeUploadResults(w http.ResponseWriter, req *http.Request, status int, results []uploadResult) {
+	if !wantsJSON(req) {
+		body := ""
+		for _, r := range results {
+			if r.err == nil {
+				body += resultLine(r)
+				continue
+			}
+			_, code := uploadErrorCode(r.err)
+			if code == ErrCodeInternalError {
+				// notest
+				body += "error: Internal Server Error\n"
+				continue
+			}
+			body += "error: " + r.err.Error() + "\n"
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+		return
+	}
+
+	resp := uploadResponseJSON{Files: make([]fileJSON, 0)}
+	for _, r := range results {
+		if r.err != nil {
+			_, code := uploadErrorCode(r.err)
+			msg := r.err.Error()
+			if code == ErrCodeInternalError {
+				// notest
+				msg = "Internal Server Error"
+			}
+			e := errorJSON{Code: code, Message: msg, File: r.fname}
+			resp.Errors = append(resp.Errors, e)
+			continue
+		}
+		f := fileJSON{
+			Path:        r.path,
+			Size:        r.size,
+			Sha256:      r.sha256,
+			Overwritten: r.overwritten,
+			URL:         fileURL(req, r.path),
+		}
+		resp.Files = append(resp.Files, f)
+	}
+	writeJSON(w, status, resp)
+}
+
+// writeSyncReport writes the response for a mirror or dry run
+// extraction. The plain text body has one line for each change, like
+// `A path` for added, `U path` for updated and `D path` for removed files.
+// Entries refused in a dry run are `R path: error`.
+func writeSyncReport(w http.ResponseWriter, req *http.Request, status int, report *syncReport) {
+	if wantsJSON(req) {
+		writeJSON(w, status, report)
+		return
+	}
+	body := ""
+	for _, name := range report.Added {
+		body += "A " + name + "\n"
+	}
+	for _, name := range report.Updated {
+		body += "U " + name + "\n"
+	}
+	for _, name := range report.Removed {
+		body += "D " + name + "\n"
+	}
+	for _, e := range report.Rejected {
+		body += "R " + e.File + ": " + e.Message + "\n"
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// resultLine returns the line in the response body for a stored file.
+// For regular files it uses the same format of the sha256sum program.
+func resultLine(r uploadResult) string {
+	if r.sha256 == "" {
+		return r.fname + "\n"
+	}
+	return r.sha256 + "  " + r.fname + "\n"
+}
+
+// fileURL returns the public url for a file inside the root dir.
+func fileURL(req *http.Request, fpath string) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme: scheme,
+		Host:   req.Host,
+		Path:   "/" + strings.TrimLeft(fpath, "/"),
+	}
+	return u.String()
+}
@@ -0,0 +1,68 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestWantsJSON(t *testing.T) {
+	var tests = []struct {
+		accept string
+		json   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", true},
+		{"text/html, application/json; q=0.5", true},
+		{"application/jsonx", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", test.accept)
+		if wantsJSON(req) != test.json {
+			t.Errorf("Bad wantsJSON for %s", test.accept)
+		}
+	}
+}
+
+func TestUploadErrorCode(t *testing.T) {
+	var tests = []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errors.New(INVALID_PREFIX_MSG), 400, ErrCodeInvalidPrefix},
+		{errors.New("File a.txt already exists"), 400, ErrCodeAlreadyExists},
+		{errors.New(CHECKSUM_MISMATCH_MSG), 400, ErrCodeChecksumMismatch},
+		{&http.MaxBytesError{Limit: 10}, 413, ErrCodeTooLarge},
+		{errors.New(EXTRACT_LIMIT_MSG + " 10 entries"), 413, ErrCodeTooLarge},
+		{errors.New(INVALID_ENTRY_MSG + " ../a"), 400, ErrCodeInvalidFileName},
+		{errors.New(UNSUPPORTED_ENTRY_MSG + " fifo"), 415, ErrCodeUnsupportedArchive},
+		{errors.New(PRECONDITION_FAILED_MSG), 412, ErrCodePreconditionFailed},
+		{errors.New("something else"), 500, ErrCodeInternalError},
+	}
+	for _, test := range tests {
+		status, code := uploadErrorCode(test.err)
+		if status != test.status || code != test.code {
+			t.Errorf("Bad code for %s: %d %s", test.err, status, code)
+		}
+	}
+}
@@ -18,7 +18,6 @@
 package tupi
 
 import (
-	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -26,6 +25,8 @@ import (
 	"mime/multipart"
 	"net"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -55,6 +56,7 @@ func (w *StatusedResponseWriter) WriteHeader(code int) {
 
 type RequestError struct {
 	StatusCode int
+	Code       string
 	Err        error
 }
 
@@ -84,6 +86,7 @@ func (s *TupiServer) LoadPlugins() {
 }
 
 func (s *TupiServer) Run() {
+	go runJanitor(s.Conf)
 	wg := new(sync.WaitGroup)
 	for _, serv := range s.Servers {
 		serv := serv
@@ -161,15 +164,19 @@ func (s *TupiPortServer) Run() error {
 func route(w http.ResponseWriter, req *http.Request) {
 	c := getConfigForRequest(req)
 	Debugf("config: %+v", c)
-	if shouldAuthenticate(req, c) {
-		ok, status := authenticate(req, c)
+	if hasValidSignature(req, c) {
+		// a signed url replaces the authentication
+		req = withoutSignature(req)
+	} else if shouldAuthenticate(req, c) {
+		ok, status, user := authenticate(req, c)
 		if !ok {
 			if c.AuthPlugin == "" {
 				w.Header().Set("WWW-Authenticate", "Basic realm=xZsd234-1M82sa")
 			}
-			http.Error(w, "Bad auth", status)
+			writeError(w, req, status, statusErrorCode(status), "Bad auth")
 			return
 		}
+		req = withUser(req, user)
 	}
 	if c.ServePlugin == "" {
 		serveDefaultTupi(w, req, c)
@@ -181,10 +188,24 @@ func route(w http.ResponseWriter, req *http.Request) {
 
 // Does the default tupi actions, serve and receive files.
 func serveDefaultTupi(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
-	if req.URL.Path == c.UploadPath {
+	if isTusRequest(req, c) {
+		serveTus(w, req, c)
+	} else if req.URL.Path == c.UploadPath {
 		recieveFile(w, req, c)
 	} else if req.URL.Path == c.ExtractPath {
 		recieveAndExtract(w, req, c)
+	} else if c.UsagePath != "" && req.URL.Path == c.UsagePath {
+		showUsage(w, req, c)
+	} else if c.RollbackPath != "" && req.URL.Path == c.RollbackPath {
+		serveReleases(w, req, c)
+	} else if isVersionRequest(req, c) && req.Method == http.MethodPost {
+		restoreVersion(w, req, c)
+	} else if isVersionRequest(req, c) {
+		serveVersion(w, req, c)
+	} else if req.Method == http.MethodPut && c.AllowPut {
+		recievePut(w, req, c)
+	} else if req.Method == http.MethodDelete && c.isAuthMethod(http.MethodDelete) {
+		deleteFile(w, req, c)
 	} else {
 		showFile(w, req, c)
 	}
@@ -201,55 +222,334 @@ func servePlugin(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
 
 func recieveFile(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
 
-	reader, err := checkUploadRequest(w, req, c)
+	q, err := requestQuota(req, c)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	reader, err := checkUploadRequest(w, req, c, q)
 	if err != nil {
 		e, _ := err.(*RequestError)
-		http.Error(w, string(err.Error()), e.StatusCode)
+		writeError(w, req, e.StatusCode, e.Code, e.Error())
+		return
+	}
+	opts := newUploadOptions(c)
+	opts.quota = q
+	opts.preconditions = requestPreconditions(req)
+	opts.digest, err = requestDigest(req)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	dir, userDir, err := uploadDir(req, c)
+	if err != nil {
+		writeUploadError(w, req, err)
 		return
 	}
-	fname, err := writeFile(c.RootDir, reader, false, c.PreventOverwrite)
+	results, err := writeFile(dir, reader, opts)
 	if err != nil && err != io.EOF {
-		if isBadRequest(err) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		// notest
-		Errorf("%s\n", err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeUploadError(w, req, err)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fname + "\n"))
+	inSubDir(results, userDir)
+	// With a single file the client gets the etag to use in the
+	// conditional headers of the next upload.
+	if len(results) == 1 && results[0].err == nil {
+		w.Header().Set("ETag", quoteETag(results[0].sha256))
+	}
+	// If any of the files failed the status is the status of the failure
+	// but we still inform which files were stored.
+	status := http.StatusCreated
+	for _, r := range results {
+		if r.err != nil {
+			status, _ = uploadErrorCode(r.err)
+		}
+	}
+	writeUploadResults(w, req, status, results)
 }
 
 func recieveAndExtract(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
-	reader, err := checkUploadRequest(w, req, c)
+	q, err := requestQuota(req, c)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	reader, err := checkUploadRequest(w, req, c, q)
 	if err != nil {
 		e, _ := err.(*RequestError)
-		http.Error(w, string(err.Error()), e.StatusCode)
+		writeError(w, req, e.StatusCode, e.Code, e.Error())
 		return
 	}
-	f, err := getFileFromRequest(reader)
+	digest, err := requestDigest(req)
 	if err != nil {
-		// notest
-		Errorf("%s\n", err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeUploadError(w, req, err)
 		return
 	}
-	freader := bytes.NewBuffer(f.content)
-	files, err := extractFiles(freader, c.RootDir, c.PreventOverwrite)
+	dir, userDir, err := uploadDir(req, c)
 	if err != nil {
-		// notest
-		Errorf("%s\n", err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeUploadError(w, req, err)
+		return
+	}
+	// when deploying releases the root dir may not exist yet
+	tmpDir := dir
+	if c.DeployReleases > 0 {
+		tmpDir = releasesDir(dir)
+		err = os.MkdirAll(tmpDir, 0755)
+		if err != nil {
+			// notest
+			writeUploadError(w, req, err)
+			return
+		}
+	}
+	// the archives are not stored so they don't replace any file
+	archiveOpts := uploadOptions{digest: digest, quota: q, collision: collisionError}
+	u, err := getFileFromRequest(reader, tmpDir, archiveOpts)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	defer u.discard()
+	if len(u.files) == 0 {
+		writeUploadError(w, req, errors.New(NO_FILE_MSG))
 		return
 	}
+	// all the archives must be ok before we extract anything
+	for _, f := range u.files {
+		if err := f.verify(); err != nil {
+			writeUploadError(w, req, err)
+			return
+		}
+	}
+	prefix := strings.Trim(u.prefix, "/")
+	if !isValidPrefix(prefix) {
+		writeUploadError(w, req, errors.New(INVALID_PREFIX_MSG))
+		return
+	}
+	// a release is always a mirror of the archives
+	if c.DeployReleases > 0 && (u.mirror || u.dryRun) {
+		writeError(w, req, http.StatusBadRequest, ErrCodeBadRequest,
+			"mirror and dryrun can't be used when deploying releases")
+		return
+	}
+	target := filepath.Join(dir, prefix)
+	opts := newUploadOptions(c)
+	opts.quota = q
+	err = opts.expiry.setFrom(u.expires)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	if u.dryRun {
+		report, err := planSync(u.files, target, u.mirror, opts)
+		if err != nil {
+			writeUploadError(w, req, err)
+			return
+		}
+		report.inSubDir(path.Join(userDir, prefix))
+		writeSyncReport(w, req, http.StatusOK, report)
+		return
+	}
+	var files []uploadResult
+	if c.DeployReleases > 0 {
+		// a release is always the whole root dir
+		if prefix != "" {
+			writeUploadError(w, req, errors.New(INVALID_PREFIX_MSG))
+			return
+		}
+		files, err = deployArchives(u.files, dir, c.DeployReleases, opts)
+	} else {
+		files, err = extractUploadedFiles(u.files, target, opts)
+	}
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	if u.mirror {
+		report, err := syncExtracted(files, c.RootDir, target, true)
+		if err != nil {
+			// notest
+			writeUploadError(w, req, err)
+			return
+		}
+		report.inSubDir(path.Join(userDir, prefix))
+		writeSyncReport(w, req, http.StatusCreated, report)
+		return
+	}
+	inSubDir(files, path.Join(userDir, prefix))
+
+	writeUploadResults(w, req, http.StatusCreated, files)
+}
 
-	w.WriteHeader(http.StatusCreated)
+func extractUploadedFiles(files []*uploadedFile, root_dir string, opts uploadOptions) ([]uploadResult, error) {
+	results := make([]uploadResult, 0)
 	for _, f := range files {
-		w.Write([]byte(f + "\n"))
+		extracted, err := extractUploadedFile(f, root_dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, extracted...)
+	}
+	return results, nil
+}
+
+func extractUploadedFile(f *uploadedFile, root_dir string, opts uploadOptions) ([]uploadResult, error) {
+	freader, err := os.Open(f.tmpPath)
+	if err != nil {
+		// notest
+		return nil, err
+	}
+	defer freader.Close()
+	return extractFiles(freader, f.size, root_dir, opts)
+}
+
+// recievePut stores the raw body of a PUT request in the file
+// addressed by the url path.
+func recievePut(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
+	if containsDotDot(req.URL.Path) || isInternalPath(req.URL.Path) {
+		writeError(w, req, http.StatusBadRequest, ErrCodeBadRequest, "invalid URL path")
+		return
+	}
+	if !isUserPath(req, c) {
+		writeUploadError(w, req, errors.New(NO_USER_MSG))
+		return
+	}
+	prefix, fname := path.Split(strings.TrimLeft(req.URL.Path, "/"))
+	if fname == "" {
+		writeUploadError(w, req, errors.New(NO_FILE_MSG))
+		return
+	}
+	if req.ContentLength > c.MaxUploadSize {
+		writeError(w, req, http.StatusRequestEntityTooLarge, ErrCodeTooLarge,
+			"Request Entity Too Large")
+		return
+	}
+	digest, err := requestDigest(req)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	// a link inside the root dir must not let us write outside it
+	fpath := filepath.Join(c.RootDir, filepath.FromSlash(prefix), fname)
+	realRoot, err := filepath.EvalSymlinks(c.RootDir)
+	if err != nil {
+		writeHTTPError(w, req, err)
+		return
+	}
+	ok, err := parentWithinDir(c.RootDir, realRoot, fpath)
+	if err != nil || !ok {
+		writeError(w, req, http.StatusForbidden, ErrCodeForbidden, "403 Forbidden")
+		return
+	}
+	q, err := requestQuota(req, c)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	// the size of the file replaced is released from the quota
+	credit := q.credit(fpath)
+	err = q.check(req.ContentLength - credit)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	body := http.MaxBytesReader(w, req.Body, c.MaxUploadSize)
+	f, err := writeTempFile(c.RootDir, q.limitReader(body, -credit))
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	defer f.discard()
+	f.fname = fname
+	f.expectedSha256 = digest
+	prefix = strings.TrimRight(prefix, "/")
+	// the file name is the one in the url, not one from the
+	// naming strategy.
+	opts := newUploadOptions(c)
+	opts.naming = ""
+	opts.quota = q
+	opts.preconditions = requestPreconditions(req)
+	err = opts.expiry.setFrom(req.URL.Query().Get("expires"))
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	r := storeFile(c.RootDir, prefix, f, opts)
+	if r.err != nil {
+		writeUploadError(w, req, r.err)
+		return
+	}
+	w.Header().Set("ETag", quoteETag(r.sha256))
+	if r.overwritten {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
+	writeUploadResults(w, req, http.StatusCreated, []uploadResult{r})
+}
 
+// deleteFile removes a file or a directory inside the root dir.
+// Directories are only removed with their contents if the
+// query param `recursive` is true.
+func deleteFile(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
+	if containsDotDot(req.URL.Path) {
+		writeError(w, req, http.StatusBadRequest, ErrCodeBadRequest, "invalid URL path")
+		return
+	}
+	if isInternalPath(req.URL.Path) {
+		writeError(w, req, http.StatusNotFound, ErrCodeNotFound, "404 page not found")
+		return
+	}
+	if !isUserPath(req, c) {
+		writeUploadError(w, req, errors.New(NO_USER_MSG))
+		return
+	}
+	root := filepath.Clean(c.RootDir)
+	fpath := filepath.Join(root, req.URL.Path)
+	if fpath == root {
+		writeError(w, req, http.StatusForbidden, ErrCodeForbidden,
+			"Can't delete the root directory")
+		return
+	}
+	// The file itself may be a symlink, that is removed without
+	// following it, but its parent must be inside the root dir.
+	parent, err := filepath.EvalSymlinks(filepath.Dir(fpath))
+	if err != nil {
+		writeHTTPError(w, req, err)
+		return
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil || !isWithinDir(realRoot, parent) {
+		writeError(w, req, http.StatusForbidden, ErrCodeForbidden, "403 Forbidden")
+		return
+	}
+	fpath = filepath.Join(parent, filepath.Base(fpath))
+
+	AcquireLock(fpath)
+	defer ReleaseLock(fpath)
+
+	st, err := os.Lstat(fpath)
+	if err != nil {
+		writeHTTPError(w, req, err)
+		return
+	}
+	recursive, _ := strconv.ParseBool(req.URL.Query().Get("recursive"))
+	if st.IsDir() && !recursive && !isEmptyDir(fpath) {
+		writeError(w, req, http.StatusConflict, ErrCodeConflict, "Directory not empty")
+		return
+	}
+	if st.IsDir() && recursive {
+		err = os.RemoveAll(fpath)
+	} else {
+		err = os.Remove(fpath)
+	}
+	if err != nil {
+		// notest
+		Errorf("%s\n", err.Error())
+		writeHTTPError(w, req, err)
+		return
+	}
+	removeInternalFiles(realRoot, fpath, st.IsDir())
+	forgetUsage(fpath)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func showFile(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
@@ -262,14 +562,26 @@ func showFile(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
 		http.Error(w, "invalid URL path", http.StatusBadRequest)
 		return
 	}
+	if isInternalPath(req.URL.Path) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if format := req.URL.Query().Get("archive"); format != "" {
+		serveDirArchive(w, req, c, format)
+		return
+	}
 
 	fpath := req.URL.Path
 	if strings.HasSuffix(fpath, "/") && *c.DefaultToIndex {
 		fpath += indexFile
 	}
 	path := c.RootDir + fpath
+	if isExpired(c.RootDir, path) {
+		http.Error(w, "410 gone", http.StatusGone)
+		return
+	}
 	dir, file := filepath.Split(path)
-	serveFile(w, req, http.Dir(dir), file)
+	serveFile(w, req, http.Dir(dir), file, newServeOptions(c))
 }
 
 // Returns a certificate based on the host config.
@@ -346,22 +658,41 @@ func (r *RequestError) Error() string {
 }
 
 func shouldAuthenticate(req *http.Request, c *DomainConfig) bool {
-	for _, meth := range c.AuthMethods {
-		if strings.ToUpper(meth) == strings.ToUpper(req.Method) {
-			return true
+	method := req.Method
+	// resumable uploads are authenticated the same way
+	// as the multipart uploads.
+	if isTusRequest(req, c) {
+		if method == http.MethodOptions {
+			return false
 		}
+		method = http.MethodPost
+	}
+	// raw body uploads are always authenticated
+	if c.AllowPut && method == http.MethodPut {
+		return true
 	}
-	return false
+	if c.UsagePath != "" && req.URL.Path == c.UsagePath {
+		return true
+	}
+	if c.RollbackPath != "" && req.URL.Path == c.RollbackPath {
+		return true
+	}
+	// restoring a version changes the file like an upload
+	if isVersionRequest(req, c) && method == http.MethodPost {
+		return true
+	}
+	return c.isAuthMethod(method)
 }
 
 func checkUploadRequest(
 	w http.ResponseWriter, req *http.Request,
-	c *DomainConfig) (*multipart.Reader, error) {
+	c *DomainConfig, q *quota) (*multipart.Reader, error) {
 	err := &RequestError{}
 
 	if req.Method != "POST" {
 		Debugf("bad method for upload %s ", req.Method)
 		err.StatusCode = http.StatusMethodNotAllowed
+		err.Code = ErrCodeMethodNotAllowed
 		err.Err = errors.New("Method not allowed")
 		return nil, err
 	}
@@ -370,15 +701,27 @@ func checkUploadRequest(
 	if !strings.HasPrefix(ctype, UPLOAD_CONTENT_TYPE) {
 		msg := "Bad request. Use Content-Type: " + UPLOAD_CONTENT_TYPE
 		err.StatusCode = http.StatusBadRequest
+		err.Code = ErrCodeBadContentType
 		err.Err = errors.New(msg)
 		return nil, err
 	}
 
+	// the request body has more than the files, so here we only
+	// check if the quota is not already full. The files are checked
+	// while they are written.
+	if qerr := q.check(0); qerr != nil {
+		err.StatusCode = http.StatusInsufficientStorage
+		err.Code = ErrCodeQuotaExceeded
+		err.Err = qerr
+		return nil, err
+	}
+
 	req.Body = http.MaxBytesReader(w, req.Body, c.MaxUploadSize)
 	reader, mperr := req.MultipartReader()
 	if mperr != nil {
 		// notest
 		err.StatusCode = http.StatusBadRequest
+		err.Code = ErrCodeBadRequest
 		err.Err = errors.New("Bad request")
 		return nil, err
 	}
@@ -411,11 +754,6 @@ func getIp(req *http.Request) string {
 	return ip
 }
 
-func isBadRequest(err error) bool {
-	msg := err.Error()
-	return msg == INVALID_PREFIX_MSG || strings.Contains(msg, "already exists")
-}
-
 // for tests
 
 var startServerTestFn startServerFn = nil
@@ -19,7 +19,10 @@ package tupi
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -250,6 +253,304 @@ func TestRecieveFile(t *testing.T) {
 	}
 }
 
+func TestRecieveFile_MultipleFiles(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	server := setupTestServer(rdir, func(c *DomainConfig) {
+		c.PreventOverwrite = true
+	})
+
+	sumX := "2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881"
+	sumY := "a1fce4363854ff888cff4b8e7875d600c2682390412a8cf79b37d0b11148b0fa"
+	var tests = []struct {
+		fnames []string
+		status int
+		body   string
+	}{
+		{[]string{"a.txt", "b.txt"}, 201,
+			sumX + "  a.txt\n" + sumY + "  b.txt\n"},
+		{[]string{"a.txt", "c.txt"}, 400,
+			"error: File a.txt already exists\n" + sumY + "  c.txt\n"},
+	}
+	for _, test := range tests {
+		buf, boundary, _ := createMultiFileBufferReader(
+			test.fnames, []string{"x", "y"}, "some-prefix")
+		req, _ := http.NewRequest("POST", "/u/", buf)
+		req.SetBasicAuth("test", "123")
+		req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d", w.Code, test.status)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("got body %q, expected %q", w.Body.String(), test.body)
+		}
+	}
+	if !fileExists(filepath.Join(rdir, "some-prefix", "c.txt")) {
+		t.Errorf("c.txt not stored")
+	}
+}
+
+func TestRecieveFile_JSON(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	server := setupTestServer(rdir, func(c *DomainConfig) {
+		c.MaxUploadSize = 1000
+		c.PreventOverwrite = true
+	})
+
+	var tests = []struct {
+		fnames   []string
+		contents []string
+		prefix   string
+		passwd   string
+		status   int
+		files    []string
+		errors   []string
+	}{
+		{[]string{"a.txt"}, []string{"x"}, "pre", "123", 201,
+			[]string{"pre/a.txt"}, nil},
+		{[]string{"a.txt", "b.txt"}, []string{"x", "y"}, "pre", "123", 400,
+			[]string{"pre/b.txt"}, []string{ErrCodeAlreadyExists}},
+		{[]string{"a.txt"}, []string{"x"}, "../pre", "123", 400,
+			nil, []string{ErrCodeInvalidPrefix}},
+		{[]string{"a.txt"}, []string{"x"}, "pre", "456", 401,
+			nil, []string{ErrCodeUnauthorized}},
+		{[]string{"big.txt"}, []string{strings.Repeat("x", 2000)}, "", "123", 413,
+			nil, []string{ErrCodeTooLarge}},
+	}
+	for _, test := range tests {
+		buf, boundary, _ := createMultiFileBufferReader(
+			test.fnames, test.contents, test.prefix)
+		req, _ := http.NewRequest("POST", "/u/", buf)
+		req.Host = "localhost:8000"
+		req.SetBasicAuth("test", test.passwd)
+		req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+		req.Header.Set("Accept", "text/plain, application/json;q=0.9")
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d", w.Code, test.status)
+		}
+		if w.Header().Get("Content-Type") != JSON_CONTENT_TYPE {
+			t.Fatalf("Bad content type %s", w.Header().Get("Content-Type"))
+		}
+
+		var resp struct {
+			uploadResponseJSON
+			Error errorJSON `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Bad json response %s", w.Body.String())
+		}
+		errors := resp.Errors
+		if resp.Error.Code != "" {
+			errors = append(errors, resp.Error)
+		}
+		if len(resp.Files) != len(test.files) || len(errors) != len(test.errors) {
+			t.Fatalf("Bad response %s", w.Body.String())
+		}
+		for i, f := range resp.Files {
+			if f.Path != test.files[i] || f.URL != "http://localhost:8000/"+test.files[i] {
+				t.Errorf("Bad file in response %+v", f)
+			}
+		}
+		for i, e := range errors {
+			if e.Code != test.errors[i] {
+				t.Errorf("Bad error code %s, expected %s", e.Code, test.errors[i])
+			}
+		}
+	}
+}
+
+func TestRecievePut(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	outdir := "/tmp/tupitest-out"
+	os.MkdirAll(rdir, 0755)
+	os.MkdirAll(outdir, 0755)
+	defer os.RemoveAll(rdir)
+	defer os.RemoveAll(outdir)
+	os.Symlink(outdir, filepath.Join(rdir, "out"))
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 10,
+		AllowPut:      true,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	var tests = []struct {
+		path   string
+		host   string
+		body   string
+		user   string
+		status int
+	}{
+		{"/some/dir/file.txt", "", "oi", "test", 201},
+		{"/some/dir/file.txt", "", "oi again", "test", 204},
+		{"/some/dir/file.txt", "", "oi", "", 401},
+		{"/some/dir/", "", "oi", "test", 400},
+		{"/some/dir", "", "oi", "test", 400},
+		{"/some/../../file.txt", "", "oi", "test", 400},
+		{"/.tupi/file.txt", "", "oi", "test", 400},
+		{"/out/file.txt", "", "oi", "test", 403},
+		{"/out/dir/file.txt", "", "oi", "test", 403},
+		{"/big.txt", "", "this is too big", "test", 413},
+		{"/u/", "", "oi", "test", 405},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", test.path, strings.NewReader(test.body))
+		if test.user != "" {
+			req.SetBasicAuth(test.user, "123")
+		}
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s", w.Code, test.status, test.path)
+		}
+	}
+
+	b, _ := os.ReadFile(filepath.Join(rdir, "some", "dir", "file.txt"))
+	if string(b) != "oi again" {
+		t.Errorf("Bad file content %s", b)
+	}
+	if fileExists(filepath.Join(rdir, "big.txt")) {
+		t.Errorf("Too big file stored")
+	}
+	if entries, _ := os.ReadDir(outdir); len(entries) != 0 {
+		t.Errorf("file stored outside the root dir")
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	outdir := "/tmp/tupitest-out"
+	os.MkdirAll(filepath.Join(rdir, "dir"), 0755)
+	os.MkdirAll(filepath.Join(rdir, "empty"), 0755)
+	os.MkdirAll(outdir, 0755)
+	defer os.RemoveAll(rdir)
+	defer os.RemoveAll(outdir)
+	os.WriteFile(filepath.Join(rdir, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(rdir, "dir", "b.txt"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(outdir, "x.txt"), []byte("x"), 0644)
+	os.Symlink(outdir, filepath.Join(rdir, "out"))
+
+	dconf := DomainConfig{
+		Port:         8000,
+		RootDir:      rdir,
+		HtpasswdFile: "./testdata/htpasswd",
+		AuthMethods:  []string{"POST", "DELETE"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	conf.Domains["nodelete"] = DomainConfig{Port: 8000, RootDir: rdir}
+	server := SetupServer(conf)
+
+	var tests = []struct {
+		path   string
+		host   string
+		user   string
+		status int
+	}{
+		{"/a.txt", "nodelete:8000", "", 405},
+		{"/a.txt", "", "", 401},
+		{"/a.txt", "", "test", 204},
+		{"/a.txt", "", "test", 404},
+		{"/dir", "", "test", 409},
+		{"/dir?recursive=true", "", "test", 204},
+		{"/empty", "", "test", 204},
+		{"/", "", "test", 403},
+		{"/../tupitest-out/x.txt", "", "test", 400},
+		{"/out/x.txt", "", "test", 403},
+		{"/out", "", "test", 204},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("DELETE", test.path, nil)
+		req.Host = test.host
+		if test.user != "" {
+			req.SetBasicAuth(test.user, "123")
+		}
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s", w.Code, test.status, test.path)
+		}
+	}
+
+	if !fileExists(filepath.Join(outdir, "x.txt")) {
+		t.Errorf("File outside root dir removed")
+	}
+	if fileExists(filepath.Join(rdir, "dir")) {
+		t.Errorf("Directory not removed")
+	}
+}
+
+func TestDeleteFile_InternalFiles(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	internal := filepath.Join(rdir, internalDirName)
+	os.MkdirAll(filepath.Join(rdir, "dir"), 0755)
+	os.MkdirAll(filepath.Join(internal, "versions", "a.txt,v"), 0755)
+	os.MkdirAll(filepath.Join(internal, "meta", "dir"), 0755)
+	os.WriteFile(filepath.Join(rdir, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(rdir, "dir", "b.txt"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(internal, "meta", "a.txt,meta"), []byte("{}"), 0644)
+	os.WriteFile(filepath.Join(internal, "versions", "a.txt,v", "1"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(internal, "meta", "dir", "b.txt,meta"), []byte("{}"), 0644)
+
+	dconf := DomainConfig{
+		Port:         8000,
+		RootDir:      rdir,
+		HtpasswdFile: "./testdata/htpasswd",
+		AuthMethods:  []string{"POST", "DELETE"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	var tests = []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/dir", 409, `{"error":{"code":"CONFLICT","message":"Directory not empty"}}`},
+		{"/missing.txt", 404, `{"error":{"code":"NOT_FOUND","message":"404 page not found"}}`},
+		{"/a.txt", 204, ""},
+		{"/dir?recursive=true", 204, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("DELETE", test.path, nil)
+		req.SetBasicAuth("test", "123")
+		req.Header.Set("Accept", JSON_CONTENT_TYPE)
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s", w.Code, test.status, test.path)
+		}
+		if strings.TrimSpace(w.Body.String()) != test.body {
+			t.Errorf("bad body %s for %s", w.Body.String(), test.path)
+		}
+	}
+	for _, p := range []string{"meta/a.txt,meta", "versions/a.txt,v", "meta/dir"} {
+		if fileExists(filepath.Join(internal, p)) {
+			t.Errorf("internal file %s not removed", p)
+		}
+	}
+}
+
 func TestRecieveAndExtract(t *testing.T) {
 	fpath := "./testdata/htpasswd"
 	var tests = []struct {
@@ -331,6 +632,105 @@ func TestRecieveAndExtract(t *testing.T) {
 	}
 }
 
+func TestRecieveAndExtract_Checksum(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 10 << 20,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	b, _ := os.ReadFile("./testdata/test.tar.gz")
+	sum := sha256.Sum256(b)
+	var tests = []struct {
+		digest string
+		status int
+	}{
+		{"sha-256=:" + base64.StdEncoding.EncodeToString([]byte("bad")) + ":", 400},
+		{"sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, 32)) + ":", 400},
+		{"sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":", 201},
+	}
+	for _, test := range tests {
+		pr, boundary, _ := createMultipartPipeReader("test.tar.gz", b)
+		req, _ := http.NewRequest("POST", "/e/", pr)
+		req.SetBasicAuth("test", "123")
+		req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+		req.Header.Set("Content-Digest", test.digest)
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d", w.Code, test.status)
+		}
+		if test.status != 201 && fileExists(filepath.Join(rdir, "bla")) {
+			t.Errorf("Files extracted with bad checksum")
+		}
+	}
+}
+
+func TestRecieveAndExtract_Prefix(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 10 << 20,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	b, _ := os.ReadFile("./testdata/test.tar.gz")
+	var tests = []struct {
+		prefix string
+		status int
+		fpath  string
+	}{
+		{"/sites/a/", 201, "sites/a/bla/one.txt"},
+		{"", 201, "bla/one.txt"},
+		{"../a", 400, ""},
+		{"sites/../../a", 400, ""},
+		{".tupi/a", 400, ""},
+	}
+	for _, test := range tests {
+		buf, boundary, _ := createMultiFileBufferReader(
+			[]string{"test.tar.gz"}, []string{string(b)}, test.prefix)
+		req, _ := http.NewRequest("POST", "/e/", buf)
+		req.SetBasicAuth("test", "123")
+		req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("got %d, expected %d for %s", w.Code, test.status, test.prefix)
+		}
+		if test.fpath == "" {
+			continue
+		}
+		if !fileExists(filepath.Join(rdir, test.fpath)) {
+			t.Fatalf("file %s not extracted", test.fpath)
+		}
+		if !strings.Contains(w.Body.String(), `"path":"`+test.fpath+`"`) {
+			t.Fatalf("bad response %s", w.Body.String())
+		}
+	}
+}
+
 func TestHTTPServer_RunOneServer(t *testing.T) {
 	called := false
 	startServerTestFn = func(s *http.Server, use_ssl bool) error {
@@ -0,0 +1,119 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query params of the signed urls. The expiration of the signature
+// is not `expires` as it is the expiration of uploaded files.
+const (
+	signExpiresParam = "sig_expires"
+	signParam        = "sig"
+)
+
+// signableMethods are the methods that can be signed. They act only on
+// the path of the url, unlike a POST to the upload path that may store
+// files anywhere inside the root dir.
+var signableMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+}
+
+// SignURL returns a url that allows requests using `method` to `rawURL`
+// until `expires` without any other authentication. `rawURL` is a path
+// with an optional query string and the returned url is the same path
+// with the `sig_expires` and `sig` query params. Only GET, HEAD, PUT
+// and DELETE urls can be signed.
+func SignURL(secret string, method string, rawURL string, expires time.Time) (string, error) {
+	if secret == "" {
+		return "", errors.New("Empty signing secret")
+	}
+	if !signableMethods[strings.ToUpper(method)] {
+		return "", errors.New("Method " + method + " can't be signed")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" || !strings.HasPrefix(u.Path, "/") {
+		return "", errors.New("Invalid path " + rawURL)
+	}
+	q := u.Query()
+	q.Del(signParam)
+	q.Set(signExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(signParam, signature(secret, method, u.Path, q))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// signature returns the hex encoded hmac of the method, the path and
+// the query params, except the signature itself.
+func signature(secret string, method string, path string, q url.Values) string {
+	params := url.Values{}
+	for k, v := range q {
+		if k != signParam {
+			params[k] = v
+		}
+	}
+	msg := strings.ToUpper(method) + "\n" + path + "\n" + params.Encode()
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hasValidSignature informs if the request has a valid, not expired,
+// signature for its method, path and query params.
+func hasValidSignature(req *http.Request, c *DomainConfig) bool {
+	if c.SigningSecret == "" || !signableMethods[req.Method] {
+		return false
+	}
+	q := req.URL.Query()
+	sig := q.Get(signParam)
+	if sig == "" {
+		return false
+	}
+	expires, err := strconv.ParseInt(q.Get(signExpiresParam), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := signature(c.SigningSecret, req.Method, req.URL.Path, q)
+	return hmac.Equal([]byte(sig), []byte(expected))
+}
+
+// withoutSignature returns a copy of the request without the signature
+// query params, so they are not taken as params of the request.
+func withoutSignature(req *http.Request) *http.Request {
+	r := req.Clone(req.Context())
+	q := r.URL.Query()
+	q.Del(signParam)
+	q.Del(signExpiresParam)
+	r.URL.RawQuery = q.Encode()
+	return r
+}
@@ -0,0 +1,161 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignURL(t *testing.T) {
+	var tests = []struct {
+		secret  string
+		method  string
+		url     string
+		has_err bool
+	}{
+		{"s3cr3t", "GET", "/some/file.txt", false},
+		{"s3cr3t", "GET", "/some/file.txt?version=2", false},
+		{"s3cr3t", "PUT", "/some/file.txt?expires=3600", false},
+		{"", "GET", "/some/file.txt", true},
+		{"s3cr3t", "GET", "some/file.txt", true},
+		{"s3cr3t", "POST", "/u/", true},
+	}
+	exp := time.Now().Add(time.Hour)
+	for _, test := range tests {
+		u, err := SignURL(test.secret, test.method, test.url, exp)
+		if (err != nil) != test.has_err {
+			t.Fatalf("bad error for %s %s: %v", test.method, test.url, err)
+		}
+		if test.has_err {
+			continue
+		}
+		req, _ := http.NewRequest(test.method, u, nil)
+		c := &DomainConfig{SigningSecret: test.secret}
+		if !hasValidSignature(req, c) {
+			t.Errorf("invalid signature for %s", u)
+		}
+		params := req.URL.Query()
+		req = withoutSignature(req)
+		if req.URL.Query().Has("sig") || req.URL.Query().Has("sig_expires") {
+			t.Errorf("signature not removed %s", req.URL)
+		}
+		if req.URL.Query().Get("expires") != params.Get("expires") {
+			t.Errorf("file expiration removed %s", req.URL)
+		}
+	}
+}
+
+func TestHasValidSignature(t *testing.T) {
+	c := &DomainConfig{SigningSecret: "s3cr3t"}
+	good, _ := SignURL("s3cr3t", "GET", "/file.txt", time.Now().Add(time.Hour))
+	expired, _ := SignURL("s3cr3t", "GET", "/file.txt", time.Now().Add(-time.Hour))
+	other, _ := SignURL("other", "GET", "/file.txt", time.Now().Add(time.Hour))
+	// signed with the secret but for a method that can't be signed
+	q := url.Values{}
+	q.Set("sig_expires", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	q.Set("sig", signature("s3cr3t", "POST", "/u/", q))
+	post := "/u/?" + q.Encode()
+	var tests = []struct {
+		method string
+		url    string
+		ok     bool
+	}{
+		{"GET", good, true},
+		{"PUT", good, false},
+		{"GET", strings.Replace(good, "/file.txt", "/other.txt", 1), false},
+		{"GET", good + "&recursive=true", false},
+		{"GET", expired, false},
+		{"GET", other, false},
+		{"GET", "/file.txt", false},
+		{"POST", post, false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.url, nil)
+		if hasValidSignature(req, c) != test.ok {
+			t.Errorf("bad signature check for %s %s", test.method, test.url)
+		}
+	}
+	if hasValidSignature(httptest.NewRequest("GET", good, nil), &DomainConfig{}) {
+		t.Errorf("signature accepted without secret")
+	}
+}
+
+func TestRoute_SignedURL(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 1000,
+		AllowPut:      true,
+		SigningSecret: "s3cr3t",
+		AuthMethods:   []string{"POST", "GET"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+	handler := server.Servers[0].Server.Handler
+
+	exp := time.Now().Add(time.Hour)
+	put, _ := SignURL("s3cr3t", "PUT", "/dir/file.txt", exp)
+	get, _ := SignURL("s3cr3t", "GET", "/dir/file.txt", exp)
+	putExpires, _ := SignURL("s3cr3t", "PUT", "/dir/expires.txt?expires=3600", exp)
+	var tests = []struct {
+		method string
+		url    string
+		status int
+	}{
+		{"PUT", "/dir/file.txt", 401},
+		{"PUT", put, 201},
+		{"GET", put, 401},
+		{"GET", "/dir/file.txt", 401},
+		{"GET", get, 200},
+		{"PUT", putExpires, 201},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.url, strings.NewReader("oi"))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s %s",
+				w.Code, test.status, test.method, test.url)
+		}
+	}
+	// the signature is not taken as the expiration of the file
+	if _, err := readMeta(rdir, filepath.Join(rdir, "dir", "file.txt")); err == nil {
+		t.Errorf("signed upload with expiration")
+	}
+	// but the file expiration can be signed
+	m, err := readMeta(rdir, filepath.Join(rdir, "dir", "expires.txt"))
+	if err != nil || m.Expires.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("bad expiration for signed upload %+v %v", m, err)
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// syncReport informs which files were added, updated and removed
+// by an extraction. In a dry run nothing is changed and the report
+// informs what would change.
+type syncReport struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+	DryRun  bool     `json:"dryRun"`
+	// entries that would make the extraction fail. Only in dry runs.
+	Rejected []errorJSON `json:"rejected,omitempty"`
+	// names in the archives, with their parent dirs.
+	kept map[string]bool
+}
+
+func newSyncReport(dryRun bool) *syncReport {
+	return &syncReport{
+		Added:   make([]string, 0),
+		Updated: make([]string, 0),
+		Removed: make([]string, 0),
+		DryRun:  dryRun,
+		kept:    make(map[string]bool),
+	}
+}
+
+// add adds an entry of an archive to the report. Directories
+// are not reported.
+func (r *syncReport) add(name string, isDir bool, exists bool) {
+	name = filepath.ToSlash(filepath.Clean(name))
+	if r.kept[name] {
+		return
+	}
+	for p := name; p != "." && p != "/" && !r.kept[p]; p = path.Dir(p) {
+		r.kept[p] = true
+	}
+	if isDir {
+		return
+	}
+	if exists {
+		r.Updated = append(r.Updated, name)
+	} else {
+		r.Added = append(r.Added, name)
+	}
+}
+
+// reject adds to the report an entry that would make the
+// extraction fail.
+func (r *syncReport) reject(name string, err error) {
+	_, code := uploadErrorCode(err)
+	r.Rejected = append(r.Rejected, errorJSON{
+		Code:    code,
+		Message: err.Error(),
+		File:    filepath.ToSlash(filepath.Clean(name)),
+	})
+}
+
+// inSubDir makes the paths of the report relative to the root dir
+// instead of the sub dir `name` where the archive is extracted.
+func (r *syncReport) inSubDir(name string) {
+	if name == "" {
+		return
+	}
+	for _, names := range [][]string{r.Added, r.Updated, r.Removed} {
+		for i := range names {
+			names[i] = path.Join(name, names[i])
+		}
+	}
+	for i := range r.Rejected {
+		r.Rejected[i].File = path.Join(name, r.Rejected[i].File)
+	}
+}
+
+// planSync reports what would change if the archives were extracted
+// in `root_dir`. With `mirror` the files not in the archives would
+// be removed. The entries are checked as they are when extracted, so
+// the entries that would be refused are reported. Archives beyond the
+// extraction limits are refused.
+func planSync(files []*uploadedFile, root_dir string, mirror bool, opts uploadOptions) (*syncReport, error) {
+	report := newSyncReport(true)
+	for _, f := range files {
+		err := planArchive(report, f, root_dir, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// nothing is removed if the extraction fails
+	if mirror && len(report.Rejected) == 0 {
+		stale, err := staleFiles(root_dir, report.kept)
+		if err != nil {
+			// notest
+			return nil, err
+		}
+		report.Removed = stale
+	}
+	return report, nil
+}
+
+// syncPlanner checks the entries of an archive without extracting it.
+type syncPlanner struct {
+	report  *syncReport
+	rootDir string
+	// root dir with its links resolved or empty if it does not exist.
+	realRoot string
+	counter  *extractCounter
+	opts     uploadOptions
+	// the regular files in the archives, by path.
+	files map[string]plannedFile
+}
+
+// plannedFile is a regular file of an archive.
+type plannedFile struct {
+	size int64
+	head []byte
+}
+
+func planArchive(report *syncReport, f *uploadedFile, root_dir string, opts uploadOptions) error {
+	fd, err := os.Open(f.tmpPath)
+	if err != nil {
+		// notest
+		return err
+	}
+	defer fd.Close()
+	ar, err := openArchive(fd, f.size)
+	if err != nil {
+		return err
+	}
+	defer ar.close()
+	p := &syncPlanner{
+		report:  report,
+		rootDir: filepath.Clean(root_dir),
+		counter: &extractCounter{limits: opts.limits, size: f.size},
+		opts:    opts,
+		files:   make(map[string]plannedFile),
+	}
+	if real, err := filepath.EvalSymlinks(p.rootDir); err == nil {
+		p.realRoot = real
+	}
+	for {
+		hdr, err := ar.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = p.counter.entry()
+		}
+		if err != nil {
+			return err
+		}
+		err = p.plan(hdr)
+		if err != nil && strings.HasPrefix(err.Error(), EXTRACT_LIMIT_MSG) {
+			return err
+		}
+		if err != nil {
+			report.reject(hdr.name, err)
+		}
+	}
+}
+
+// path returns the path where an entry would be extracted.
+func (p *syncPlanner) path(name string) (string, error) {
+	if p.realRoot == "" {
+		// nothing was extracted yet so there are no links.
+		return entryPath(p.rootDir, name)
+	}
+	return extractPath(p.rootDir, p.realRoot, name)
+}
+
+// plan checks an entry of an archive as extractFiles does and adds it
+// to the report.
+func (p *syncPlanner) plan(hdr *archiveEntry) error {
+	fpath, err := p.path(hdr.name)
+	if err != nil {
+		return err
+	}
+	if fpath == p.rootDir {
+		if hdr.typeflag != tar.TypeDir {
+			return errors.New(INVALID_ENTRY_MSG + " " + hdr.name)
+		}
+		return nil
+	}
+	_, err = os.Lstat(fpath)
+	exists := err == nil
+	if exists && hdr.typeflag != tar.TypeDir && p.opts.collision == collisionError {
+		return errors.New("File " + hdr.name + " already exists")
+	}
+	switch hdr.typeflag {
+	case tar.TypeReg:
+		hw := &headWriter{}
+		size, err := io.Copy(hw, p.counter.reader(hdr.r))
+		if err != nil {
+			return err
+		}
+		err = p.opts.filter.check(hdr.name, hw.head)
+		if err != nil {
+			return err
+		}
+		p.files[fpath] = plannedFile{size: size, head: hw.head}
+
+	case tar.TypeLink:
+		err := p.planLink(fpath, hdr)
+		if err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		err := p.opts.filter.checkName(hdr.name)
+		if err != nil {
+			return err
+		}
+		target := symlinkTarget(p.rootDir, fpath, hdr.linkname)
+		if isInternalTarget(p.rootDir, p.realRoot, target) {
+			return errors.New(INVALID_ENTRY_MSG + " " + hdr.name)
+		}
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return errors.New(UNSUPPORTED_ENTRY_MSG + " " + hdr.name)
+	}
+	p.report.add(hdr.name, hdr.typeflag == tar.TypeDir, exists)
+	return nil
+}
+
+// planLink checks a hard link extracted to `fpath`. The linked file
+// must be a regular file of the archives or one that already exists.
+func (p *syncPlanner) planLink(fpath string, hdr *archiveEntry) error {
+	src, err := p.path(hdr.linkname)
+	if err != nil {
+		return err
+	}
+	f, ok := p.files[src]
+	if !ok {
+		f, err = readPlannedFile(src)
+		if err != nil {
+			return errors.New(INVALID_ENTRY_MSG + " " + hdr.name)
+		}
+	}
+	if p.opts.preserve.links {
+		err = p.opts.filter.checkName(hdr.name)
+	} else {
+		// the link is extracted as a copy of the file.
+		err = p.counter.add(f.size)
+		if err == nil {
+			err = p.opts.filter.check(hdr.name, f.head)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	p.files[fpath] = f
+	return nil
+}
+
+// readPlannedFile returns the size and the head of an existing
+// regular file.
+func readPlannedFile(fpath string) (plannedFile, error) {
+	f := plannedFile{}
+	fd, err := os.Open(fpath)
+	if err != nil {
+		return f, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return f, errors.New(fpath + " is not a regular file")
+	}
+	hw := &headWriter{}
+	_, err = io.CopyN(hw, fd, sniffLen)
+	if err != nil && err != io.EOF {
+		// notest
+		return f, err
+	}
+	f.size = info.Size()
+	f.head = hw.head
+	return f, nil
+}
+
+// syncExtracted reports the files extracted in `root_dir`. With
+// `mirror` the files not in the archives are removed, with their
+// internal files in the domain `root`.
+func syncExtracted(results []uploadResult, root string, root_dir string, mirror bool) (*syncReport, error) {
+	report := newSyncReport(false)
+	for _, r := range results {
+		info, err := os.Lstat(filepath.Join(root_dir, r.fname))
+		isDir := err == nil && info.IsDir()
+		report.add(r.fname, isDir, r.overwritten)
+	}
+	if !mirror {
+		return report, nil
+	}
+	stale, err := staleFiles(root_dir, report.kept)
+	if err != nil {
+		// notest
+		return nil, err
+	}
+	for _, name := range stale {
+		fpath := filepath.Join(root_dir, filepath.FromSlash(name))
+		AcquireLock(fpath)
+		info, err := os.Lstat(fpath)
+		if err == nil {
+			err = os.RemoveAll(fpath)
+		}
+		if err == nil {
+			removeInternalFiles(root, fpath, info.IsDir())
+		}
+		ReleaseLock(fpath)
+		if err != nil {
+			// notest
+			return nil, err
+		}
+		forgetUsage(fpath)
+		report.Removed = append(report.Removed, name)
+	}
+	return report, nil
+}
+
+// staleFiles returns the files and directories inside `root_dir` that
+// are not in `kept`. The contents of a stale directory are not listed.
+// Internal files are never stale.
+func staleFiles(root_dir string, kept map[string]bool) ([]string, error) {
+	stale := make([]string, 0)
+	err := filepath.WalkDir(root_dir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			// notest
+			return err
+		}
+		rel, _ := filepath.Rel(root_dir, fpath)
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if kept[rel] {
+			return nil
+		}
+		if !isInternalPath(d.Name()) {
+			stale = append(stale, rel)
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return stale, err
+}
@@ -0,0 +1,300 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStaleFiles(t *testing.T) {
+	dir := "/tmp/tupitest-sync"
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	os.MkdirAll(filepath.Join(dir, "c"), 0755)
+	os.MkdirAll(filepath.Join(dir, internalDirName, "meta"), 0755)
+	os.WriteFile(filepath.Join(dir, "a", "b", "x.txt"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "a", "y.txt"), []byte("y"), 0644)
+	os.WriteFile(filepath.Join(dir, "c", "z.txt"), []byte("z"), 0644)
+	os.WriteFile(filepath.Join(dir, ".tupi-upload-1"), []byte("1"), 0644)
+	kept := map[string]bool{"a": true, "a/b": true, "a/b/x.txt": true}
+
+	stale, err := staleFiles(dir, kept)
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if !reflect.DeepEqual(stale, []string{"a/y.txt", "c"}) {
+		t.Fatalf("bad stale files %v", stale)
+	}
+
+	stale, err = staleFiles(filepath.Join(dir, "missing"), kept)
+	if err != nil || len(stale) != 0 {
+		t.Fatalf("bad stale files for missing dir %v %v", stale, err)
+	}
+}
+
+func TestRecieveAndExtract_Mirror(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	site := filepath.Join(rdir, "site")
+	os.MkdirAll(filepath.Join(site, "olddir"), 0755)
+	os.MkdirAll(filepath.Join(site, "bla"), 0755)
+	defer os.RemoveAll(rdir)
+	os.WriteFile(filepath.Join(rdir, "other.txt"), []byte("o"), 0644)
+	os.WriteFile(filepath.Join(site, "old.txt"), []byte("o"), 0644)
+	os.WriteFile(filepath.Join(site, "olddir", "x.txt"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(site, "bla", "one.txt"), []byte("1"), 0644)
+
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 10 << 20,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	added := []string{
+		"site/bla/ble/bad.txt", "site/bla/ble/four.txt",
+		"site/bla/ble/three.txt", "site/bla/two.txt"}
+	all := []string{
+		"site/bla/ble/bad.txt", "site/bla/ble/four.txt",
+		"site/bla/ble/three.txt", "site/bla/one.txt", "site/bla/two.txt"}
+	var tests = []struct {
+		fields map[string]string
+		status int
+		report syncReport
+		exists []string
+		gone   []string
+	}{
+		{map[string]string{"prefix": "site", "dryrun": "true"}, 200,
+			syncReport{Added: added, Updated: []string{"site/bla/one.txt"},
+				Removed: []string{}, DryRun: true},
+			[]string{"site/old.txt", "site/olddir/x.txt"},
+			[]string{"site/bla/two.txt"}},
+		{map[string]string{"prefix": "site", "dryrun": "1", "mirror": "1"}, 200,
+			syncReport{Added: added, Updated: []string{"site/bla/one.txt"},
+				Removed: []string{"site/old.txt", "site/olddir"}, DryRun: true},
+			[]string{"site/old.txt", "site/olddir/x.txt"},
+			[]string{"site/bla/two.txt"}},
+		{map[string]string{"prefix": "site", "mirror": "true"}, 201,
+			syncReport{Added: added, Updated: []string{"site/bla/one.txt"},
+				Removed: []string{"site/old.txt", "site/olddir"}},
+			[]string{"other.txt", "site/bla/two.txt", "site/bla/ble/four.txt"},
+			[]string{"site/old.txt", "site/olddir"}},
+		// extracting it again only updates the files
+		{map[string]string{"prefix": "site", "mirror": "true"}, 201,
+			syncReport{Added: []string{}, Updated: all, Removed: []string{}},
+			[]string{"other.txt", "site/bla/two.txt", "site/bla/ble/four.txt"},
+			[]string{}},
+	}
+	b, _ := os.ReadFile("./testdata/test.tar.gz")
+	for _, test := range tests {
+		buf, boundary, _ := createFieldsBufferReader("test.tar.gz", b, test.fields)
+		req, _ := http.NewRequest("POST", "/e/", buf)
+		req.SetBasicAuth("test", "123")
+		req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("got %d, expected %d for %v", w.Code, test.status, test.fields)
+		}
+		var report syncReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		sort.Strings(report.Added)
+		sort.Strings(report.Updated)
+		if !reflect.DeepEqual(report, test.report) {
+			t.Fatalf("bad report %+v for %v", report, test.fields)
+		}
+		for _, name := range test.exists {
+			if _, err := os.Lstat(filepath.Join(rdir, name)); err != nil {
+				t.Fatalf("%s does not exist", name)
+			}
+		}
+		for _, name := range test.gone {
+			if _, err := os.Lstat(filepath.Join(rdir, name)); err == nil {
+				t.Fatalf("%s exists", name)
+			}
+		}
+	}
+}
+
+func TestRecieveAndExtract_MirrorText(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	os.WriteFile(filepath.Join(rdir, "old.txt"), []byte("o"), 0644)
+	os.WriteFile(filepath.Join(rdir, "one.txt"), []byte("1"), 0644)
+	// the internal files of the removed files are removed too
+	vdir := filepath.Join(rdir, ".tupi", "versions", "old.txt,v")
+	os.MkdirAll(vdir, 0755)
+	os.WriteFile(filepath.Join(vdir, "1"), []byte("o"), 0644)
+	mpath := filepath.Join(rdir, ".tupi", "meta", "old.txt,meta")
+	os.MkdirAll(filepath.Dir(mpath), 0755)
+	os.WriteFile(mpath, []byte("{}"), 0644)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 10 << 20,
+		AuthMethods:   []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	b := createTestTarGz([]testEntry{
+		{"one.txt", tar.TypeReg, "", "one"},
+		{"two.txt", tar.TypeReg, "", "two"},
+	})
+	buf, boundary, _ := createFieldsBufferReader(
+		"a.tar.gz", b, map[string]string{"mirror": "true"})
+	req, _ := http.NewRequest("POST", "/e/", buf)
+	req.SetBasicAuth("test", "123")
+	req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+	w := httptest.NewRecorder()
+	server.Servers[0].Server.Handler.ServeHTTP(w, req)
+
+	expected := "A two.txt\nU one.txt\nD old.txt\n"
+	if w.Code != 201 || w.Body.String() != expected {
+		t.Fatalf("bad response %d %q", w.Code, w.Body.String())
+	}
+	for _, ipath := range []string{vdir, mpath} {
+		if _, err := os.Lstat(ipath); err == nil {
+			t.Fatalf("%s exists", ipath)
+		}
+	}
+}
+
+func TestRecieveAndExtract_MirrorRelease(t *testing.T) {
+	dir := "/tmp/tupitest-deploy"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	server := deployTestServer(filepath.Join(dir, "site"))
+
+	b, _ := os.ReadFile("./testdata/test.tar.gz")
+	buf, boundary, _ := createFieldsBufferReader(
+		"test.tar.gz", b, map[string]string{"mirror": "true"})
+	req, _ := http.NewRequest("POST", "/e/", buf)
+	req.SetBasicAuth("test", "123")
+	req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+	w := httptest.NewRecorder()
+	server.Servers[0].Server.Handler.ServeHTTP(w, req)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "mirror") {
+		t.Fatalf("bad response %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRecieveAndExtract_DryRunChecks(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	os.WriteFile(filepath.Join(rdir, "old.txt"), []byte("o"), 0644)
+	os.WriteFile(filepath.Join(rdir, "one.txt"), []byte("1"), 0644)
+	collision := collisionError
+	maxEntries := int64(10)
+	dconf := DomainConfig{
+		Port:                 8000,
+		RootDir:              rdir,
+		HtpasswdFile:         "./testdata/htpasswd",
+		UploadPath:           "/u/",
+		ExtractPath:          "/e/",
+		MaxUploadSize:        10 << 20,
+		UploadDenyExtensions: []string{".exe"},
+		UploadDenyTypes:      []string{"image/png"},
+		OnCollision:          &collision,
+		MaxExtractEntries:    &maxEntries,
+		AuthMethods:          []string{"POST"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+
+	png := "\x89PNG\r\n\x1a\n0000"
+	var tests = []struct {
+		entries []testEntry
+		status  int
+		body    string
+	}{
+		{[]testEntry{
+			{"./", tar.TypeDir, "", ""},
+			{"./two.txt", tar.TypeReg, "", "two"},
+			{"copy.txt", tar.TypeLink, "two.txt", ""},
+			{"run.exe", tar.TypeReg, "", "x"},
+			{"image.txt", tar.TypeReg, "", png},
+			{"one.txt", tar.TypeReg, "", "one"},
+			{"fifo", tar.TypeFifo, "", ""},
+			{"link.png", tar.TypeLink, "image.txt", ""},
+			{"../evil.txt", tar.TypeReg, "", "x"},
+			{"tus", tar.TypeSymlink, ".tupi/tus", ""},
+		}, 200,
+			"A two.txt\nA copy.txt\n" +
+				"R run.exe: " + UNSUPPORTED_TYPE_MSG + ": run.exe\n" +
+				"R image.txt: " + UNSUPPORTED_TYPE_MSG + ": image.txt\n" +
+				"R one.txt: File one.txt already exists\n" +
+				"R fifo: " + UNSUPPORTED_ENTRY_MSG + " fifo\n" +
+				"R link.png: " + INVALID_ENTRY_MSG + " link.png\n" +
+				"R ../evil.txt: " + INVALID_ENTRY_MSG + " ../evil.txt\n" +
+				"R tus: " + INVALID_ENTRY_MSG + " tus\n"},
+		// the limits refuse the whole archive
+		{[]testEntry{
+			{"1.txt", tar.TypeReg, "", "1"}, {"2.txt", tar.TypeReg, "", "2"},
+			{"3.txt", tar.TypeReg, "", "3"}, {"4.txt", tar.TypeReg, "", "4"},
+			{"5.txt", tar.TypeReg, "", "5"}, {"6.txt", tar.TypeReg, "", "6"},
+			{"7.txt", tar.TypeReg, "", "7"}, {"8.txt", tar.TypeReg, "", "8"},
+			{"9.txt", tar.TypeReg, "", "9"}, {"10.txt", tar.TypeReg, "", "10"},
+			{"11.txt", tar.TypeReg, "", "11"},
+		}, 413, ""},
+	}
+	for _, test := range tests {
+		b := createTestTarGz(test.entries)
+		buf, boundary, _ := createFieldsBufferReader(
+			"a.tar.gz", b, map[string]string{"mirror": "true", "dryrun": "true"})
+		req, _ := http.NewRequest("POST", "/e/", buf)
+		req.SetBasicAuth("test", "123")
+		req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+		w := httptest.NewRecorder()
+		server.Servers[0].Server.Handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("got %d, expected %d: %s", w.Code, test.status, w.Body.String())
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Fatalf("bad report %q", w.Body.String())
+		}
+	}
+	if fileExists(filepath.Join(rdir, "two.txt")) || !fileExists(filepath.Join(rdir, "old.txt")) {
+		t.Fatalf("files changed in a dry run")
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import "net/http"
+
+func Authenticate(r *http.Request, domain string, conf *map[string]any) (bool, int, string) {
+	user := r.Header.Get("X-User")
+	if user == "" {
+		return false, 403, ""
+	}
+	return true, 200, user
+}
@@ -43,6 +43,50 @@ func createBufferMultipartReader(fname string, content string, prefix string) (*
 	bw.Close()
 	return buf, bw.Boundary(), nil
 }
+
+func createMultiFileBufferReader(fnames []string, contents []string, prefix string) (*bytes.Buffer, string, error) {
+	buf := new(bytes.Buffer)
+	bw := multipart.NewWriter(buf)
+
+	field, err := bw.CreateFormField("prefix")
+	if err != nil {
+		return nil, "", err
+	}
+	field.Write([]byte(prefix))
+
+	for i, fname := range fnames {
+		file, err := bw.CreateFormFile("file", fname)
+		if err != nil {
+			return nil, "", err
+		}
+		file.Write([]byte(contents[i]))
+	}
+
+	bw.Close()
+	return buf, bw.Boundary(), nil
+}
+
+func createFieldsBufferReader(fname string, content []byte, fields map[string]string) (*bytes.Buffer, string, error) {
+	buf := new(bytes.Buffer)
+	bw := multipart.NewWriter(buf)
+
+	for name, value := range fields {
+		field, err := bw.CreateFormField(name)
+		if err != nil {
+			return nil, "", err
+		}
+		field.Write([]byte(value))
+	}
+	file, err := bw.CreateFormFile("file", fname)
+	if err != nil {
+		return nil, "", err
+	}
+	file.Write(content)
+
+	bw.Close()
+	return buf, bw.Boundary(), nil
+}
+
 func createMultipartPipeReader(fname string, content []byte) (
 	*io.PipeReader, string, error) {
 	// https://stackoverflow.com/questions/43904974/
@@ -76,3 +120,25 @@ func createMultipartReader(fname string, content []byte) (
 	}
 	return reader, nil
 }
+
+// setupTestServer returns a server with a default domain serving `rdir`
+// that accepts authenticated uploads. `configure`, if not nil, changes
+// the config of the domain before the server is set up.
+func setupTestServer(rdir string, configure func(c *DomainConfig)) TupiServer {
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 10 << 20,
+		AuthMethods:   []string{"POST"},
+	}
+	if configure != nil {
+		configure(&dconf)
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	return SetupServer(conf)
+}
@@ -0,0 +1,501 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+// Resumable uploads using the tus 1.0 protocol.
+// See https://tus.io/protocols/resumable-upload
+// The core protocol and the creation, expiration and termination
+// extensions are implemented.
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TUS_VERSION = "1.0.0"
+const TUS_EXTENSIONS = "creation,expiration,termination"
+const TUS_CONTENT_TYPE = "application/offset+octet-stream"
+
+// tusUpload is the information about an upload in progress. It is
+// stored in a json file alongside the uploaded data.
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata"`
+	Expires  time.Time         `json:"expires"`
+	// The user that created the upload when UserDirs is set.
+	User string `json:"user,omitempty"`
+	// where the data is stored. Not saved in the info file.
+	dir string
+}
+
+func (u *tusUpload) dataPath() string {
+	return filepath.Join(u.dir, u.ID)
+}
+
+func (u *tusUpload) infoPath() string {
+	return filepath.Join(u.dir, u.ID+".info")
+}
+
+// offset returns how many bytes were already received.
+func (u *tusUpload) offset() (int64, error) {
+	st, err := os.Stat(u.dataPath())
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+func (u *tusUpload) isExpired() bool {
+	return time.Now().After(u.Expires)
+}
+
+func (u *tusUpload) save() error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		// notest
+		return err
+	}
+	return os.WriteFile(u.infoPath(), b, 0600)
+}
+
+func (u *tusUpload) remove() {
+	os.Remove(u.dataPath())
+	os.Remove(u.infoPath())
+}
+
+func loadTusUpload(dir string, id string) (*tusUpload, error) {
+	b, err := os.ReadFile(filepath.Join(dir, id+".info"))
+	if err != nil {
+		return nil, err
+	}
+	u := &tusUpload{}
+	err = json.Unmarshal(b, u)
+	if err != nil {
+		return nil, err
+	}
+	u.dir = dir
+	return u, nil
+}
+
+// tusDir returns the directory where the uploads in progress are stored.
+// It is inside the root dir so the finished uploads can be renamed
+// to their final place.
+func tusDir(c *DomainConfig) string {
+	return filepath.Join(c.RootDir, internalDirName, "tus")
+}
+
+func isTusRequest(req *http.Request, c *DomainConfig) bool {
+	return c.TusPath != "" && strings.HasPrefix(req.URL.Path, c.TusPath)
+}
+
+// serveTus handles the requests for resumable uploads
+func serveTus(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
+	w.Header().Set("Tus-Resumable", TUS_VERSION)
+	if req.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", TUS_VERSION)
+		w.Header().Set("Tus-Extension", TUS_EXTENSIONS)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(c.MaxUploadSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if req.Header.Get("Tus-Resumable") != TUS_VERSION {
+		w.Header().Set("Tus-Version", TUS_VERSION)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	dir := tusDir(c)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		// notest
+		Errorf("%s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, c.TusPath)
+	if id == "" {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createTusUpload(w, req, c, dir)
+		return
+	}
+
+	if strings.ContainsAny(id, "/\\.") {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	AcquireLock(filepath.Join(dir, id))
+	defer ReleaseLock(filepath.Join(dir, id))
+
+	u, err := loadTusUpload(dir, id)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	// with user dirs only the owner of an upload knows it exists.
+	if c.UserDirs && u.User != requestUser(req) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if u.isExpired() {
+		u.remove()
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodHead:
+		headTusUpload(w, u)
+
+	case http.MethodPatch:
+		patchTusUpload(w, req, c, u)
+
+	case http.MethodDelete:
+		u.remove()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createTusUpload handles the creation extension. The metadata may have
+// `filename` and `prefix` keys, that work the same way as the fields
+// of a multipart upload.
+func createTusUpload(w http.ResponseWriter, req *http.Request, c *DomainConfig, dir string) {
+	cleanupTusUploads(dir)
+
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > c.MaxUploadSize {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseTusMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	if filepath.Base(meta["filename"]) != meta["filename"] || meta["filename"] == "" {
+		http.Error(w, NO_FILE_MSG, http.StatusBadRequest)
+		return
+	}
+	if !isValidPrefix(meta["prefix"]) {
+		http.Error(w, INVALID_PREFIX_MSG, http.StatusBadRequest)
+		return
+	}
+	// relative expirations are from the creation of the upload
+	if meta["expires"] != "" {
+		t, err := parseExpires(meta["expires"], time.Now())
+		if err != nil {
+			writeUploadError(w, req, err)
+			return
+		}
+		meta["expires"] = t.Format(time.RFC3339)
+	}
+	root, _, err := uploadDir(req, c)
+	if err == nil {
+		err = checkTusUpload(root, meta, c)
+	}
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	q, err := requestQuota(req, c)
+	if err == nil {
+		err = q.check(length)
+	}
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+
+	id, err := genTusID()
+	if err != nil {
+		// notest
+		Errorf("%s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	u := &tusUpload{
+		ID:       id,
+		Length:   length,
+		Metadata: meta,
+		Expires:  tusExpiration(c),
+		User:     requestUser(req),
+		dir:      dir,
+	}
+	err = os.WriteFile(u.dataPath(), []byte{}, 0644)
+	if err == nil {
+		err = u.save()
+	}
+	if err != nil {
+		// notest
+		u.remove()
+		Errorf("%s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", c.TusPath+id)
+	if length == 0 {
+		_, err := finishTusUpload(u, c)
+		if err != nil {
+			writeUploadError(w, req, err)
+			return
+		}
+	} else {
+		w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func headTusUpload(w http.ResponseWriter, u *tusUpload) {
+	offset, err := u.offset()
+	if err != nil {
+		// notest
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchTusUpload appends the request body to the upload. When all the
+// bytes were received the file is moved to its final place.
+func patchTusUpload(w http.ResponseWriter, req *http.Request, c *DomainConfig, u *tusUpload) {
+	if req.Header.Get("Content-Type") != TUS_CONTENT_TYPE {
+		http.Error(w, "Use Content-Type: "+TUS_CONTENT_TYPE, http.StatusUnsupportedMediaType)
+		return
+	}
+	current, err := u.offset()
+	if err != nil {
+		// notest
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != current {
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		// notest
+		Errorf("%s\n", err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// Whatever we receive is kept, even if the connection breaks,
+	// so the client can resume the upload from there.
+	n, cperr := io.Copy(f, io.LimitReader(req.Body, u.Length-current))
+	f.Close()
+	offset = current + n
+
+	u.Expires = tusExpiration(c)
+	u.save()
+	if cperr != nil {
+		Debugf("error receiving tus upload %s: %s", u.ID, cperr.Error())
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if offset < u.Length {
+		w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	_, err = finishTusUpload(u, c)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTusUpload checks the rules that don't depend on the content
+// of an upload, so it is refused before anything is sent. `root` is
+// the dir where the file is stored.
+func checkTusUpload(root string, meta map[string]string, c *DomainConfig) error {
+	fname := meta["filename"]
+	opts := newUploadOptions(c)
+	err := opts.filter.checkName(fname)
+	if err != nil {
+		return err
+	}
+	// with other strategies the name depends on the content
+	if opts.naming != "" && opts.naming != namingOriginal {
+		return nil
+	}
+	fpath := filepath.Join(root, meta["prefix"], fname)
+	switch {
+	case isDir(fpath):
+		return errors.New("File " + fname + " is a directory")
+
+	case opts.collision == collisionError && fileExists(fpath):
+		return errors.New("File " + fname + " already exists")
+	}
+	return nil
+}
+
+// isPermanentTusError informs if a complete upload can never be stored
+// because of `err`. Other errors, like a file with the same name or an
+// exceeded quota, may be solved by the client, that finishes the upload
+// with a PATCH without content. Those uploads are kept until they expire.
+func isPermanentTusError(err error) bool {
+	_, code := uploadErrorCode(err)
+	switch code {
+	case ErrCodeUnsupportedType, ErrCodeInvalidFileName, ErrCodeNoFile,
+		ErrCodeChecksumMismatch:
+		return true
+	}
+	return false
+}
+
+// finishTusUpload moves a complete upload to the root dir using the
+// same rules of the multipart uploads.
+func finishTusUpload(u *tusUpload, c *DomainConfig) (string, error) {
+	// the head is needed by the type filter
+	f, err := readTempFile(u.dataPath())
+	if err != nil {
+		// notest
+		return "", err
+	}
+	f.fname = u.Metadata["filename"]
+	prefix := strings.TrimLeft(u.Metadata["prefix"], string(os.PathSeparator))
+	root := c.RootDir
+	if c.UserDirs {
+		name, err := userDirName(u.User)
+		if err != nil {
+			// notest
+			return "", err
+		}
+		root = filepath.Join(root, name)
+	}
+	opts := newUploadOptions(c)
+	err = opts.expiry.setFrom(u.Metadata["expires"])
+	if err != nil {
+		// notest
+		return "", err
+	}
+	quotaRoot := c.RootDir
+	if c.QuotaPerUser {
+		quotaRoot = root
+	}
+	q, err := newQuota(quotaRoot, c)
+	if err != nil {
+		// notest
+		return "", err
+	}
+	opts.quota = q
+	r := storeFile(root, prefix, f, opts)
+	if r.err == nil || isPermanentTusError(r.err) {
+		u.remove()
+	}
+	return r.fname, r.err
+}
+
+// cleanupTusUploads removes the expired uploads.
+func cleanupTusUploads(dir string) {
+	infos, err := filepath.Glob(filepath.Join(dir, "*.info"))
+	if err != nil {
+		// notest
+		return
+	}
+	for _, info := range infos {
+		id := strings.TrimSuffix(filepath.Base(info), ".info")
+		AcquireLock(filepath.Join(dir, id))
+		u, err := loadTusUpload(dir, id)
+		if err == nil && u.isExpired() {
+			Debugf("removing expired tus upload %s", id)
+			u.remove()
+		}
+		ReleaseLock(filepath.Join(dir, id))
+	}
+}
+
+func tusExpiration(c *DomainConfig) time.Time {
+	return time.Now().Add(time.Duration(valueOf(c.TusExpiration)) * time.Second)
+}
+
+// parseTusMetadata parses the Upload-Metadata header. It is a comma
+// separated list of key value pairs where the value is base64 encoded.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, errors.New("Invalid metadata: " + pair)
+		}
+		value := ""
+		if len(parts) == 2 {
+			b, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(b)
+		}
+		meta[parts[0]] = value
+	}
+	return meta, nil
+}
+
+func genTusID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		// notest
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
@@ -0,0 +1,352 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func setupTusServer(rdir string, expiration int) TupiServer {
+	return setupTestServer(rdir, func(c *DomainConfig) {
+		c.TusPath = "/t/"
+		c.TusExpiration = &expiration
+		c.PreventOverwrite = true
+	})
+}
+
+func doTusRequest(s TupiServer, method string, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	req.SetBasicAuth("test", "123")
+	req.Header.Set("Tus-Resumable", TUS_VERSION)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.Servers[0].Server.Handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeTus_Upload(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	server := setupTusServer(rdir, 3600)
+
+	w := doTusRequest(server, "OPTIONS", "/t/", nil, nil)
+	if w.Code != 204 || w.Header().Get("Tus-Extension") != TUS_EXTENSIONS {
+		t.Fatalf("Bad OPTIONS response %d", w.Code)
+	}
+
+	// filename: file.txt, prefix: some-prefix
+	meta := map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": "filename ZmlsZS50eHQ=,prefix c29tZS1wcmVmaXg=",
+	}
+	w = doTusRequest(server, "POST", "/t/", nil, meta)
+	if w.Code != 201 {
+		t.Fatalf("Bad status creating upload %d", w.Code)
+	}
+	location := w.Header().Get("Location")
+
+	var tests = []struct {
+		method string
+		body   string
+		offset string
+		status int
+	}{
+		{"PATCH", "01234", "0", 204},
+		{"HEAD", "", "", 200},
+		{"PATCH", "56789", "0", 409},
+		{"PATCH", "56789", "5", 204},
+		{"HEAD", "", "", 404},
+	}
+
+	for _, test := range tests {
+		headers := map[string]string{"Content-Type": TUS_CONTENT_TYPE}
+		if test.offset != "" {
+			headers["Upload-Offset"] = test.offset
+		}
+		w = doTusRequest(server, test.method, location, []byte(test.body), headers)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s", w.Code, test.status, test.method)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(rdir, "some-prefix", "file.txt"))
+	if err != nil || string(b) != "0123456789" {
+		t.Errorf("Bad uploaded file %s %v", b, err)
+	}
+}
+
+func TestServeTus_Errors(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	os.WriteFile(filepath.Join(rdir, "exists.txt"), []byte("e"), 0644)
+	server := setupTusServer(rdir, 3600)
+
+	var tests = []struct {
+		headers map[string]string
+		status  int
+	}{
+		{map[string]string{"Tus-Resumable": "0.2.0"}, 412},
+		{map[string]string{"Upload-Length": "x"}, 400},
+		{map[string]string{"Upload-Length": "20000000"}, 413},
+		{map[string]string{"Upload-Length": "2"}, 400},
+		{map[string]string{"Upload-Length": "2",
+			"Upload-Metadata": "filename YS50eHQ=,prefix Li4vYmFk"}, 400},
+		// exists.txt
+		{map[string]string{"Upload-Length": "2",
+			"Upload-Metadata": "filename ZXhpc3RzLnR4dA=="}, 400},
+	}
+	for _, test := range tests {
+		w := doTusRequest(server, "POST", "/t/", nil, test.headers)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d", w.Code, test.status)
+		}
+	}
+
+	// unauthenticated
+	req, _ := http.NewRequest("POST", "/t/", nil)
+	req.Header.Set("Tus-Resumable", TUS_VERSION)
+	w := httptest.NewRecorder()
+	server.Servers[0].Server.Handler.ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Errorf("got %d, expected 401", w.Code)
+	}
+}
+
+func TestServeTus_KeepOnConflict(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	server := setupTusServer(rdir, 3600)
+
+	// filename: file.txt
+	meta := map[string]string{
+		"Upload-Length":   "2",
+		"Upload-Metadata": "filename ZmlsZS50eHQ=",
+	}
+	w := doTusRequest(server, "POST", "/t/", nil, meta)
+	if w.Code != 201 {
+		t.Fatalf("Bad status creating upload %d", w.Code)
+	}
+	location := w.Header().Get("Location")
+	// a file with the same name stored while uploading
+	fpath := filepath.Join(rdir, "file.txt")
+	os.WriteFile(fpath, []byte("other"), 0644)
+
+	headers := map[string]string{
+		"Content-Type":  TUS_CONTENT_TYPE,
+		"Upload-Offset": "0",
+	}
+	w = doTusRequest(server, "PATCH", location, []byte("oi"), headers)
+	if w.Code != 400 {
+		t.Fatalf("got %d, expected 400", w.Code)
+	}
+	w = doTusRequest(server, "HEAD", location, nil, nil)
+	if w.Code != 200 || w.Header().Get("Upload-Offset") != "2" {
+		t.Fatalf("upload not kept %d", w.Code)
+	}
+
+	os.Remove(fpath)
+	headers["Upload-Offset"] = "2"
+	w = doTusRequest(server, "PATCH", location, nil, headers)
+	if w.Code != 204 {
+		t.Fatalf("got %d, expected 204", w.Code)
+	}
+	b, _ := os.ReadFile(fpath)
+	if string(b) != "oi" {
+		t.Errorf("Bad content %s", b)
+	}
+	w = doTusRequest(server, "HEAD", location, nil, nil)
+	if w.Code != 404 {
+		t.Errorf("upload not removed %d", w.Code)
+	}
+}
+
+func TestServeTus_TerminateAndExpire(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	server := setupTusServer(rdir, 3600)
+	meta := map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": "filename ZmlsZS50eHQ=",
+	}
+
+	w := doTusRequest(server, "POST", "/t/", nil, meta)
+	location := w.Header().Get("Location")
+	w = doTusRequest(server, "DELETE", location, nil, nil)
+	if w.Code != 204 {
+		t.Errorf("Bad status terminating upload %d", w.Code)
+	}
+	w = doTusRequest(server, "HEAD", location, nil, nil)
+	if w.Code != 404 {
+		t.Errorf("Upload not terminated %d", w.Code)
+	}
+
+	w = doTusRequest(server, "POST", "/t/", nil, meta)
+	location = w.Header().Get("Location")
+	id := filepath.Base(location)
+	u, _ := loadTusUpload(filepath.Join(rdir, ".tupi", "tus"), id)
+	u.Expires = time.Now().Add(-time.Second)
+	u.save()
+
+	w = doTusRequest(server, "HEAD", location, nil, nil)
+	if w.Code != 410 {
+		t.Errorf("Upload not expired %d", w.Code)
+	}
+	if fileExists(u.dataPath()) {
+		t.Errorf("Expired upload not removed")
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	var tests = []struct {
+		header  string
+		meta    map[string]string
+		has_err bool
+	}{
+		{"", map[string]string{}, false},
+		{"filename ZmlsZS50eHQ=,empty", map[string]string{
+			"filename": "file.txt", "empty": ""}, false},
+		{"filename not-base64", nil, true},
+		{"a b c", nil, true},
+	}
+	for _, test := range tests {
+		meta, err := parseTusMetadata(test.header)
+		if (err != nil) != test.has_err {
+			t.Errorf("Bad error for %s: %v", test.header, err)
+		}
+		if !test.has_err && !reflect.DeepEqual(meta, test.meta) {
+			t.Errorf("Bad metadata for %s: %v", test.header, meta)
+		}
+	}
+}
+
+func TestServeTus_UserDirs(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	server := setupTusServer(rdir, 3600)
+	dconf := server.Conf.Domains["default"]
+	dconf.UserDirs = true
+	server.Conf.Domains["default"] = dconf
+	setConfig(server.Conf)
+
+	meta := map[string]string{
+		"Upload-Length":   "2",
+		"Upload-Metadata": "filename ZmlsZS50eHQ=",
+	}
+	w := doTusRequest(server, "POST", "/t/", nil, meta)
+	location := w.Header().Get("Location")
+
+	// other users don't see the upload
+	req, _ := http.NewRequest("HEAD", location, nil)
+	req.SetBasicAuth("chico", "123")
+	req.Header.Set("Tus-Resumable", TUS_VERSION)
+	w = httptest.NewRecorder()
+	server.Servers[0].Server.Handler.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("Bad status for other user %d", w.Code)
+	}
+
+	w = doTusRequest(server, "PATCH", location, []byte("oi"), map[string]string{
+		"Upload-Offset": "0",
+		"Content-Type":  TUS_CONTENT_TYPE,
+	})
+	if w.Code != 204 {
+		t.Fatalf("Bad status finishing upload %d", w.Code)
+	}
+	b, _ := os.ReadFile(filepath.Join(rdir, "test", "file.txt"))
+	if string(b) != "oi" {
+		t.Errorf("Bad content %s", b)
+	}
+}
+
+func TestServeTus_TypeFilter(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	png := "\x89PNG\r\n\x1a\n" + "some image data"
+	text := "just some plain text"
+	expiration := 3600
+
+	var tests = []struct {
+		allow    []string
+		deny     []string
+		denyExts []string
+		content  string
+		status   int
+	}{
+		{[]string{"image/*"}, nil, nil, png, 204},
+		{[]string{"image/*"}, nil, nil, text, 415},
+		{nil, []string{"image/png"}, nil, png, 415},
+		{nil, []string{"image/png"}, nil, text, 204},
+		// refused when the upload is created
+		{nil, nil, []string{"bin"}, text, 415},
+	}
+	for i, test := range tests {
+		server := setupTestServer(rdir, func(c *DomainConfig) {
+			c.TusPath = "/t/"
+			c.TusExpiration = &expiration
+			c.UploadAllowTypes = test.allow
+			c.UploadDenyTypes = test.deny
+			c.UploadDenyExtensions = test.denyExts
+		})
+
+		// filename: file.bin
+		meta := map[string]string{
+			"Upload-Length":   strconv.Itoa(len(test.content)),
+			"Upload-Metadata": "filename ZmlsZS5iaW4=",
+		}
+		w := doTusRequest(server, "POST", "/t/", nil, meta)
+		if test.denyExts != nil {
+			if w.Code != test.status {
+				t.Errorf("%d: got %d, expected %d", i, w.Code, test.status)
+			}
+			continue
+		}
+		if w.Code != 201 {
+			t.Fatalf("Bad status creating upload %d", w.Code)
+		}
+		headers := map[string]string{
+			"Content-Type":  TUS_CONTENT_TYPE,
+			"Upload-Offset": "0",
+		}
+		w = doTusRequest(server, "PATCH", w.Header().Get("Location"),
+			[]byte(test.content), headers)
+		if w.Code != test.status {
+			t.Errorf("%d: got %d, expected %d", i, w.Code, test.status)
+		}
+		fpath := filepath.Join(rdir, "file.bin")
+		if fileExists(fpath) != (test.status == 204) {
+			t.Errorf("%d: bad stored file", i)
+		}
+		os.Remove(fpath)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const NO_USER_MSG = "No valid user to store files"
+
+// userDirName returns the name of the directory of a user inside the
+// root dir. Names that can't be safely used as a directory name are
+// rejected instead of changed, so two users never share a directory.
+func userDirName(user string) (string, error) {
+	if user == "" || len(user) > 255 || strings.HasPrefix(user, ".") {
+		return "", errors.New(NO_USER_MSG)
+	}
+	for _, c := range user {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9')
+		if !isAlnum && !strings.ContainsRune("._@-+", c) {
+			return "", errors.New(NO_USER_MSG)
+		}
+	}
+	return user, nil
+}
+
+// uploadDir returns the directory where the files uploaded in a
+// request are stored and the path of this directory relative to the
+// root dir. When UserDirs is set it is the directory of the
+// authenticated user, otherwise it is the root dir itself.
+func uploadDir(req *http.Request, c *DomainConfig) (string, string, error) {
+	if !c.UserDirs {
+		return c.RootDir, "", nil
+	}
+	name, err := userDirName(requestUser(req))
+	if err != nil {
+		return "", "", err
+	}
+	dir := filepath.Join(c.RootDir, name)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		// notest
+		return "", "", err
+	}
+	return dir, name, nil
+}
+
+// isUserPath informs if the url path is inside the directory of the
+// authenticated user. Always true if UserDirs is not set.
+func isUserPath(req *http.Request, c *DomainConfig) bool {
+	if !c.UserDirs {
+		return true
+	}
+	name, err := userDirName(requestUser(req))
+	if err != nil {
+		return false
+	}
+	rest, found := strings.CutPrefix(req.URL.Path, "/"+name+"/")
+	return found && strings.Trim(rest, "/") != ""
+}
+
+// inSubDir makes the path of the results relative to the root dir
+// instead of the sub dir `name` where they were stored.
+func inSubDir(results []uploadResult, name string) {
+	if name == "" {
+		return
+	}
+	for i := range results {
+		results[i].path = path.Join(name, results[i].path)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserDirName(t *testing.T) {
+	var tests = []struct {
+		user string
+		ok   bool
+	}{
+		{"test", true},
+		{"juca@poraodojuca.dev", true},
+		{"", false},
+		{".tupi", false},
+		{"..", false},
+		{"a/b", false},
+		{"zé", false},
+	}
+	for _, test := range tests {
+		_, err := userDirName(test.user)
+		if (err == nil) != test.ok {
+			t.Errorf("bad result for %q: %v", test.user, err)
+		}
+	}
+}
+
+func TestUserDirs(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 1000,
+		AllowPut:      true,
+		UserDirs:      true,
+		AuthMethods:   []string{"POST", "DELETE"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+	handler := server.Servers[0].Server.Handler
+
+	// uploads go to the dir of the user
+	for _, user := range []string{"test", "chico"} {
+		buf, boundary, _ := createMultiFileBufferReader(
+			[]string{"a.txt"}, []string{user}, "pre")
+		req, _ := http.NewRequest("POST", "/u/", buf)
+		req.Host = "localhost:8000"
+		req.SetBasicAuth(user, "123")
+		req.Header.Set("Content-Type", UPLOAD_CONTENT_TYPE+"; boundary="+boundary)
+		req.Header.Set("Accept", JSON_CONTENT_TYPE)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != 201 {
+			t.Fatalf("got %d for %s", w.Code, user)
+		}
+		resp := uploadResponseJSON{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Files[0].Path != user+"/pre/a.txt" {
+			t.Errorf("bad path %s", resp.Files[0].Path)
+		}
+		b, _ := os.ReadFile(filepath.Join(rdir, user, "pre", "a.txt"))
+		if string(b) != user {
+			t.Errorf("bad content for %s: %s", user, b)
+		}
+	}
+
+	var tests = []struct {
+		method string
+		path   string
+		user   string
+		status int
+	}{
+		{"PUT", "/test/b.txt", "test", 201},
+		{"PUT", "/chico/b.txt", "test", 403},
+		{"PUT", "/b.txt", "test", 403},
+		{"DELETE", "/chico/pre/a.txt", "test", 403},
+		{"DELETE", "/test/", "test", 403},
+		{"DELETE", "/test/pre/a.txt", "test", 204},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.path, strings.NewReader("oi"))
+		req.SetBasicAuth(test.user, "123")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s %s",
+				w.Code, test.status, test.method, test.path)
+		}
+	}
+	if !fileExists(filepath.Join(rdir, "chico", "pre", "a.txt")) {
+		t.Errorf("file of other user removed")
+	}
+}
+
+func TestUploadDir_NoUser(t *testing.T) {
+	c := &DomainConfig{RootDir: "/tmp/tupitest", UserDirs: true}
+	req, _ := http.NewRequest("POST", "/u/", nil)
+	_, _, err := uploadDir(req, c)
+	if err == nil || err.Error() != NO_USER_MSG {
+		t.Errorf("bad error %v", err)
+	}
+	status, _ := uploadErrorCode(err)
+	if status != http.StatusForbidden {
+		t.Errorf("bad status %d", status)
+	}
+}
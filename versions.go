@@ -0,0 +1,269 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Directory inside the internal dir where the previous versions of
+// the files are kept. The versions of a file are kept in a directory
+// with the same path of the file, plus a `,v` suffix, and each version
+// is named after its number.
+const versionsDirName = "versions"
+const versionsDirSuffix = ",v"
+
+// versioner keeps the previous versions of the overwritten files.
+type versioner struct {
+	root string
+	keep int
+}
+
+// newVersioner returns a versioner for a domain or nil if the domain
+// does not keep versions.
+func newVersioner(c *DomainConfig) *versioner {
+	if c.KeepVersions <= 0 {
+		return nil
+	}
+	return &versioner{root: c.RootDir, keep: c.KeepVersions}
+}
+
+// versionsDir returns the directory where the versions of a file
+// inside the root dir are kept.
+func (v *versioner) versionsDir(fpath string) (string, error) {
+	return internalFilePath(v.root, versionsDirName, fpath, versionsDirSuffix)
+}
+
+// save keeps the current content of `fpath` as a new version. The
+// file is hard linked so it is not missing until it is replaced.
+// The caller must hold the lock for `fpath`.
+func (v *versioner) save(fpath string) error {
+	if v == nil {
+		return nil
+	}
+	st, err := os.Lstat(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		// notest
+		return err
+	}
+	// only the contents of regular files are versioned
+	if !st.Mode().IsRegular() {
+		return nil
+	}
+	vdir, err := v.versionsDir(fpath)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(vdir, 0755)
+	if err != nil {
+		// notest
+		return err
+	}
+	versions := listVersions(vdir)
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1] + 1
+	}
+	err = os.Link(fpath, filepath.Join(vdir, strconv.Itoa(next)))
+	if err != nil {
+		// notest
+		return err
+	}
+	versions = append(versions, next)
+	for len(versions) > v.keep {
+		os.Remove(filepath.Join(vdir, strconv.Itoa(versions[0])))
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// versionPath returns the path of a version of `fpath`.
+func (v *versioner) versionPath(fpath string, version string) (string, error) {
+	n, err := strconv.Atoi(version)
+	if err != nil || n < 1 {
+		return "", errors.New("Invalid version " + version)
+	}
+	vdir, err := v.versionsDir(fpath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(vdir, strconv.Itoa(n)), nil
+}
+
+// listVersions returns the numbers of the versions in a versions dir
+// from the oldest to the newest.
+func listVersions(vdir string) []int {
+	entries, _ := os.ReadDir(vdir)
+	versions := make([]int, 0, len(entries))
+	for _, e := range entries {
+		n, err := strconv.Atoi(e.Name())
+		if err == nil {
+			versions = append(versions, n)
+		}
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// versionedFilePath returns the path of the file addressed by the url
+// path of a versions request.
+func versionedFilePath(w http.ResponseWriter, req *http.Request, c *DomainConfig) (string, bool) {
+	if containsDotDot(req.URL.Path) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return "", false
+	}
+	if isInternalPath(req.URL.Path) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return "", false
+	}
+	return filepath.Join(c.RootDir, filepath.FromSlash(req.URL.Path)), true
+}
+
+// serveVersion serves a previous version of a file. The version is
+// informed by the `version` query param.
+func serveVersion(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
+	v := newVersioner(c)
+	fpath, ok := versionedFilePath(w, req, c)
+	if !ok {
+		return
+	}
+	vpath, err := v.versionPath(fpath, req.URL.Query().Get("version"))
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(vpath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		// notest
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	etag, err := fileETag(vpath, f, st)
+	if err != nil {
+		// notest
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	// The name of the file is used so the content type is the same
+	// of the current version.
+	http.ServeContent(w, req, filepath.Base(fpath), st.ModTime(), f)
+}
+
+// restoreVersion replaces a file by one of its previous versions. The
+// current content of the file is kept as a new version. The restored
+// file is stored as the uploaded ones, so it counts for the quota and
+// expires.
+func restoreVersion(w http.ResponseWriter, req *http.Request, c *DomainConfig) {
+	v := newVersioner(c)
+	fpath, ok := versionedFilePath(w, req, c)
+	if !ok {
+		return
+	}
+	if !isUserPath(req, c) {
+		http.Error(w, NO_USER_MSG, http.StatusForbidden)
+		return
+	}
+	vpath, err := v.versionPath(fpath, req.URL.Query().Get("restore"))
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, ErrCodeBadRequest, "Invalid version")
+		return
+	}
+	q, err := requestQuota(req, c)
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+	opts := newUploadOptions(c)
+	// the restored file always replaces the current one
+	opts.naming = ""
+	opts.collision = collisionOverwrite
+	opts.quota = q
+	err = opts.expiry.setFrom(req.URL.Query().Get("expires"))
+	if err != nil {
+		writeUploadError(w, req, err)
+		return
+	}
+
+	vf, err := os.Open(vpath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		writeError(w, req, code, statusErrorCode(code), msg)
+		return
+	}
+	defer vf.Close()
+	err = os.MkdirAll(filepath.Dir(fpath), 0755)
+	if err != nil {
+		// notest
+		writeUploadError(w, req, err)
+		return
+	}
+	// the version is copied because it may be removed when the
+	// current file is saved as a new version.
+	f, err := writeTempFile(filepath.Dir(fpath), vf)
+	if err != nil {
+		// notest
+		writeUploadError(w, req, err)
+		return
+	}
+	defer f.discard()
+	f.fname = filepath.Base(fpath)
+	prefix, _ := filepath.Rel(c.RootDir, filepath.Dir(fpath))
+	if prefix == "." {
+		prefix = ""
+	}
+	r := storeFile(c.RootDir, prefix, f, opts)
+	if r.err != nil {
+		writeUploadError(w, req, r.err)
+		return
+	}
+	writeUploadResults(w, req, http.StatusOK, []uploadResult{r})
+}
+
+// isVersionRequest informs if a request is to get or to restore a
+// previous version of a file.
+func isVersionRequest(req *http.Request, c *DomainConfig) bool {
+	if c.KeepVersions <= 0 {
+		return false
+	}
+	q := req.URL.Query()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return q.Has("version")
+	case http.MethodPost:
+		return q.Has("restore")
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+// Copyright 2026 Juca Crispim <juca@poraodojuca.dev>
+
+// This file is part of tupi.
+
+// tupi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi. If not, see <http://www.gnu.org/licenses/>.
+
+package tupi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVersioner_Save(t *testing.T) {
+	dir := "/tmp/tupitest"
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	defer os.RemoveAll(dir)
+	v := &versioner{root: dir, keep: 2}
+	fpath := filepath.Join(dir, "a", "file.txt")
+
+	if err := v.save(fpath); err != nil {
+		t.Fatalf("error saving missing file %s", err)
+	}
+	for _, content := range []string{"1", "2", "3"} {
+		os.WriteFile(fpath, []byte(content), 0644)
+		if err := v.save(fpath); err != nil {
+			t.Fatalf("error saving version %s", err)
+		}
+		os.Remove(fpath)
+	}
+	vdir := filepath.Join(dir, ".tupi", "versions", "a", "file.txt,v")
+	if versions := listVersions(vdir); !reflect.DeepEqual(versions, []int{2, 3}) {
+		t.Errorf("bad versions %v", versions)
+	}
+	b, _ := os.ReadFile(filepath.Join(vdir, "3"))
+	if string(b) != "3" {
+		t.Errorf("bad version content %s", b)
+	}
+
+	if _, err := v.versionsDir(filepath.Join(dir, "..", "x")); err == nil {
+		t.Errorf("versions dir outside the root")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		UploadPath:    "/u/",
+		ExtractPath:   "/e/",
+		MaxUploadSize: 1000,
+		AllowPut:      true,
+		KeepVersions:  2,
+		AuthMethods:   []string{"PUT"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+	handler := server.Servers[0].Server.Handler
+
+	for _, content := range []string{"one", "two", "three"} {
+		req, _ := http.NewRequest("PUT", "/dir/file.txt", strings.NewReader(content))
+		req.SetBasicAuth("test", "123")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != 201 && w.Code != 204 {
+			t.Fatalf("bad status %d", w.Code)
+		}
+	}
+
+	var tests = []struct {
+		method string
+		query  string
+		user   string
+		status int
+		body   string
+	}{
+		{"GET", "version=1", "", 200, "one"},
+		{"GET", "version=2", "", 200, "two"},
+		{"GET", "version=bad", "", 400, ""},
+		{"POST", "restore=2", "", 401, ""},
+		{"POST", "restore=5", "test", 404, ""},
+		{"POST", "restore=2", "test", 200, ""},
+		{"GET", "", "", 200, "two"},
+		// the replaced content is a new version and the oldest is gone
+		{"GET", "version=3", "", 200, "three"},
+		{"GET", "version=1", "", 404, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "/dir/file.txt?"+test.query, nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, "123")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s %s",
+				w.Code, test.status, test.method, test.query)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("bad body %s for %s", w.Body.String(), test.query)
+		}
+	}
+}
+
+func TestRestoreVersion_QuotaAndExpiry(t *testing.T) {
+	rdir := "/tmp/tupitest"
+	os.MkdirAll(rdir, 0755)
+	defer os.RemoveAll(rdir)
+	defer forgetUsage(rdir)
+	dconf := DomainConfig{
+		Port:          8000,
+		RootDir:       rdir,
+		HtpasswdFile:  "./testdata/htpasswd",
+		MaxUploadSize: 1000,
+		AllowPut:      true,
+		KeepVersions:  2,
+		QuotaBytes:    10,
+		AuthMethods:   []string{"PUT"},
+	}
+	conf := Config{}
+	conf.Domains = make(map[string]DomainConfig)
+	conf.Domains["default"] = dconf
+	server := SetupServer(conf)
+	handler := server.Servers[0].Server.Handler
+
+	// 4 bytes in the file and 5 in the version
+	for _, content := range []string{"12345", "1234"} {
+		req, _ := http.NewRequest("PUT", "/file.txt", strings.NewReader(content))
+		req.SetBasicAuth("test", "123")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != 201 && w.Code != 204 {
+			t.Fatalf("bad status %d", w.Code)
+		}
+	}
+
+	var tests = []struct {
+		query  string
+		status int
+	}{
+		// the current content is kept as a version
+		{"restore=1", 507},
+		{"restore=1&expires=bad", 400},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/file.txt?"+test.query, nil)
+		req.SetBasicAuth("test", "123")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("got %d, expected %d for %s", w.Code, test.status, test.query)
+		}
+	}
+	b, _ := os.ReadFile(filepath.Join(rdir, "file.txt"))
+	if string(b) != "1234" {
+		t.Errorf("file restored over the quota %q", b)
+	}
+
+	// the expiration of the restored file
+	os.RemoveAll(filepath.Join(rdir, internalDirName))
+	forgetUsage(rdir)
+	os.MkdirAll(filepath.Join(rdir, internalDirName, versionsDirName, "file.txt"+versionsDirSuffix), 0755)
+	os.WriteFile(filepath.Join(rdir, internalDirName, versionsDirName, "file.txt"+versionsDirSuffix, "1"),
+		[]byte("1"), 0644)
+	req, _ := http.NewRequest("POST", "/file.txt?restore=1&expires=60", nil)
+	req.SetBasicAuth("test", "123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("got %d restoring", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(rdir, internalDirName, metaDirName, "file.txt"+metaSuffix)); err != nil {
+		t.Errorf("expiration not set %s", err)
+	}
+}